@@ -12,7 +12,11 @@ import (
 	"github.com/vndee/lensquery-backend/pkg/config"
 	"github.com/vndee/lensquery-backend/pkg/database"
 	"github.com/vndee/lensquery-backend/pkg/handler"
+	"github.com/vndee/lensquery-backend/pkg/ledger"
 	"github.com/vndee/lensquery-backend/pkg/limiter"
+	"github.com/vndee/lensquery-backend/pkg/middleware"
+	"github.com/vndee/lensquery-backend/pkg/queue"
+	"github.com/vndee/lensquery-backend/pkg/reconcile"
 	"github.com/vndee/lensquery-backend/pkg/templates"
 )
 
@@ -29,6 +33,11 @@ func Setup() *fiber.App {
 			Prefork:     *prod,
 			JSONEncoder: sonic.Marshal,
 			JSONDecoder: sonic.Unmarshal,
+
+			// c.IP() is the client behind the load balancer, never a spoofed header
+			ProxyHeader:             fiber.HeaderXForwardedFor,
+			EnableTrustedProxyCheck: true,
+			TrustedProxies:          config.TrustedProxies,
 		},
 	)
 
@@ -49,13 +58,30 @@ func Setup() *fiber.App {
 	}
 
 	database.CreateTables()
+	ledger.StartSweeper(config.LedgerSweepInterval)
+	reconcile.Start()
 
-	// err = config.LoadSubscriptionPlanConfig()
-	err = config.LoadStorePackagesConfig()
+	err = config.LoadSubscriptionPlanConfig()
 	if err != nil {
 		log.Fatalf("Failed to load subscription plan config: %v", err)
 	}
 
+	err = config.LoadStorePackagesConfig()
+	if err != nil {
+		log.Fatalf("Failed to load store packages config: %v", err)
+	}
+
+	err = config.LoadPricingCatalog()
+	if err != nil {
+		log.Fatalf("Failed to load pricing catalog: %v", err)
+	}
+	config.WatchPricingCatalog(config.PricingReloadInterval)
+
+	err = config.LoadAppleRootCAs()
+	if err != nil {
+		log.Fatalf("Failed to load Apple root certificates: %v", err)
+	}
+
 	config.SetupOpenRouterClient()
 
 	err = templates.Load()
@@ -63,6 +89,10 @@ func Setup() *fiber.App {
 		log.Fatalf("Failed to load email templates: %v", err)
 	}
 
+	// Workers apply webhook events with the configs and templates above
+	queue.Webhooks.Start(handler.ProcessQueuedWebhookEvent)
+	handler.StartWebhookSweeper(config.WebhookSweepInterval)
+
 	app.Get("/healthcheck", func(c *fiber.Ctx) error {
 		return c.SendString("OK")
 	})
@@ -77,6 +107,7 @@ func Setup() *fiber.App {
 			"GET::/privacy",
 			"GET::/api/v1/email/send",
 			"POST::/api/v1/subscription/event_hook",
+			"POST::/api/v1/subscription/app_store_notification",
 			"POST::/api/v1/account/reset_password",
 			"POST::/api/v1/account/verify_code",
 			"POST::/api/v1/account/update_password",
@@ -92,15 +123,21 @@ func Setup() *fiber.App {
 
 	ocr := v1.Group("/ocr")
 	ocr.Get("/get_equation_token", handler.GetEquationOCRAppToken)
-	ocr.Post("/get_free_text", handler.GetFreeTextContent)
-	ocr.Post("/get_document_text", handler.GetDocumentTextContent)
-	ocr.Post("/get_equation_text", handler.GetEquationTextContent)
+	ocr.Post("/get_free_text", middleware.Idempotency(), middleware.RequireSnapQuota("text"), handler.GetFreeTextContent)
+	ocr.Post("/get_document_text", middleware.Idempotency(), middleware.RequireSnapQuota("text"), handler.GetDocumentTextContent)
+	ocr.Post("/get_equation_text", middleware.Idempotency(), middleware.RequireSnapQuota("equation"), handler.GetEquationTextContent)
 
 	sub := v1.Group("/subscription")
-	sub.Post("/event_hook", handler.EventHook)
+	sub.Post("/event_hook", middleware.WebhookAuth(middleware.NewWebhookAuthenticator()), handler.EventHook)
+	sub.Post("/app_store_notification", handler.AppStoreNotification)
+	sub.Get("/status", handler.GetSubscriptionStatus)
 
 	cre := v1.Group("/credit")
 	cre.Get("/details", handler.GetUserRemainCredits)
+	cre.Get("/history", handler.GetCreditUsageHistory)
+	cre.Post("/redeem", handler.RedeemPromoCode)
+	cre.Get("/limits", handler.GetSpendingLimits)
+	cre.Put("/limits", handler.UpdateSpendingLimits)
 
 	acc := v1.Group("/account")
 	acc.Post("/activate_free_trial", handler.ActivateUserTrial)
@@ -109,10 +146,33 @@ func Setup() *fiber.App {
 	acc.Post("/verify_code", handler.VerifyCode)
 	acc.Post("/update_password", handler.ResetPassword)
 	acc.Delete("/", handler.DeleteAccount)
+	acc.Get("/notifications", handler.GetNotificationPreferences)
+	acc.Put("/notifications", handler.UpdateNotificationPreferences)
 
 	chat := v1.Group("/chat")
 	chat.Get("/models", handler.ListAvailabelModels)
-	chat.Post("/completions", handler.Completion)
+	chat.Post("/completions", middleware.Idempotency(), middleware.RequireChatEntitlement(), handler.Completion)
+
+	ref := v1.Group("/referral")
+	ref.Get("/code", handler.GetReferralCode)
+	ref.Post("/apply", handler.ApplyReferralCode)
+
+	admin := v1.Group("/admin", middleware.RequireAdmin())
+	admin.Get("/promo_codes", handler.ListPromoCodes)
+	admin.Post("/promo_codes", handler.CreatePromoCode)
+	admin.Get("/users/:uid", handler.GetAdminUserDetails)
+	admin.Post("/users/:uid/adjustments", handler.AdjustUserCredit)
+	admin.Post("/adjustments/:id/revert", handler.RevertCreditAdjustment)
+	admin.Get("/audit_logs", handler.ListAuditLogs)
+	admin.Get("/reconciliation_reports", handler.ListReconciliationReports)
+	admin.Get("/webhook_events", handler.ListWebhookEvents)
+	admin.Post("/webhook_events/:id/reprocess", handler.ReprocessWebhookEvent)
+	admin.Get("/webhook_queue", handler.GetWebhookQueueStats)
+	admin.Get("/webhook_queue/dead_letters", handler.ListDeadLetteredWebhookEvents)
+	admin.Post("/webhook_queue/dead_letters/:id/requeue", handler.RequeueWebhookEvent)
+	admin.Get("/revenue", handler.GetRevenueReport)
+	admin.Get("/account_flags", handler.ListAccountFlags)
+	admin.Post("/account_flags/:id/resolve", handler.ResolveAccountFlag)
 
 	return app
 }
@@ -0,0 +1,179 @@
+// Command replay feeds stored webhook deliveries, or a RevenueCat JSON export,
+// through the webhook processing again. With -dry-run it applies everything
+// inside a transaction it rolls back, printing the changes it would make.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/vndee/lensquery-backend/pkg/config"
+	"github.com/vndee/lensquery-backend/pkg/database"
+	"github.com/vndee/lensquery-backend/pkg/handler"
+	"github.com/vndee/lensquery-backend/pkg/ledger"
+	"github.com/vndee/lensquery-backend/pkg/model"
+	"gorm.io/gorm"
+)
+
+var (
+	source    = flag.String("source", "db", "Where to read events from: db or file")
+	file      = flag.String("file", "", "RevenueCat JSON export to read with -source=file")
+	eventType = flag.String("type", "", "Only replay events of this type")
+	userID    = flag.String("user", "", "Only replay events of this app user ID or alias")
+	from      = flag.String("from", "", "Only replay events at or after this time (RFC 3339 or YYYY-MM-DD)")
+	to        = flag.String("to", "", "Only replay events before this time (RFC 3339 or YYYY-MM-DD)")
+	dryRun    = flag.Bool("dry-run", true, "Print the changes without committing them")
+	emails    = flag.Bool("emails", false, "Email users as the live webhook would")
+)
+
+func main() {
+	flag.Parse()
+
+	f := filter{Type: *eventType, UserID: *userID}
+	var err error
+	if f.From, err = parseTime(*from); err != nil {
+		log.Fatalf("Invalid -from: %v", err)
+	}
+	if f.To, err = parseTime(*to); err != nil {
+		log.Fatalf("Invalid -to: %v", err)
+	}
+
+	if err := database.GetCloudSQLDB(); err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+
+	if err := config.LoadSubscriptionPlanConfig(); err != nil {
+		log.Fatalf("Failed to load subscription plan config: %v", err)
+	}
+
+	if err := config.LoadStorePackagesConfig(); err != nil {
+		log.Fatalf("Failed to load store packages config: %v", err)
+	}
+
+	handler.DisableEmails = *dryRun || !*emails
+	if !handler.DisableEmails {
+		config.SetupFirebase()
+	}
+
+	var items []replayItem
+	switch *source {
+	case "db":
+		items, err = loadDatabaseEvents(f)
+	case "file":
+		if *file == "" {
+			log.Fatal("-source=file needs -file")
+		}
+		items, err = loadFileEvents(*file, f)
+	default:
+		log.Fatalf("Unknown source %q", *source)
+	}
+	if err != nil {
+		log.Fatalf("Failed to load events: %v", err)
+	}
+
+	log.Printf("Replaying %d events (dry run: %v)", len(items), *dryRun)
+
+	if !*dryRun {
+		failed := 0
+		for i := range items {
+			if err := replay(&items[i]); err != nil {
+				failed++
+			}
+		}
+		log.Printf("Replayed %d events, %d failed", len(items), failed)
+		return
+	}
+
+	// Every handler goes through database.Pool, so pointing it at a
+	// transaction makes their own transactions savepoints inside it
+	pool := database.Pool
+	tx := pool.Begin()
+	if tx.Error != nil {
+		log.Fatalf("Failed to begin transaction: %v", tx.Error)
+	}
+	database.Pool = tx
+
+	for i := range items {
+		if err := dryRunReplay(tx, &items[i]); err != nil {
+			log.Fatalf("Dry run: %v", err)
+		}
+	}
+
+	database.Pool = pool
+	if err := tx.Rollback().Error; err != nil {
+		log.Fatalf("Failed to roll back: %v", err)
+	}
+	log.Println("Dry run rolled back")
+}
+
+func replay(item *replayItem) error {
+	event := item.Event
+	_, err := handler.ReplayWebhookEvent(&event, item.Payload)
+	if err != nil {
+		log.Printf("%s %s %s: %v", event.ID, event.Type, event.AppUserID, err)
+		return err
+	}
+
+	log.Printf("%s %s %s: ok", event.ID, event.Type, event.AppUserID)
+	return nil
+}
+
+// dryRunReplay applies one event inside tx and prints what it changed. A
+// failing event is rolled back to its savepoint so later ones still apply.
+func dryRunReplay(tx *gorm.DB, item *replayItem) error {
+	var lastEntryID uint
+	err := tx.Model(&model.LedgerEntry{}).Select("COALESCE(MAX(id), 0)").Scan(&lastEntryID).Error
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+
+	if err := tx.SavePoint("replay").Error; err != nil {
+		return err
+	}
+
+	event := item.Event
+	fmt.Printf("%s %s %s %s\n", time.UnixMilli(event.EventTimestampMs).UTC().Format(time.RFC3339), event.ID, event.Type, event.AppUserID)
+
+	_, err = handler.ReplayWebhookEvent(&event, item.Payload)
+	if err != nil {
+		fmt.Printf("  error: %v\n", err)
+		return tx.RollbackTo("replay").Error
+	}
+
+	var entries []model.LedgerEntry
+	if err := tx.Where("id > ?", lastEntryID).Order("id ASC").Find(&entries).Error; err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		amount := entry.Amount
+		if entry.DebitAccount == ledger.UserAccount(entry.UserID) {
+			amount = -amount
+		}
+		fmt.Printf("  credit %s %s %s -> balance %s\n", entry.UserID, entry.EntryType, amount, entry.BalanceAfter)
+	}
+
+	var subs []model.Subscription
+	if err := tx.Where("updated_at >= ?", start).Find(&subs).Error; err != nil {
+		return err
+	}
+	for _, sub := range subs {
+		fmt.Printf("  subscription %s %s %s expires %s\n", sub.UserID, sub.ProductID, sub.Status, time.UnixMilli(sub.ExpirationAtMs).UTC().Format(time.RFC3339))
+	}
+
+	var aliases []model.AccountAlias
+	if err := tx.Where("created_at >= ?", start).Find(&aliases).Error; err != nil {
+		return err
+	}
+	for _, alias := range aliases {
+		fmt.Printf("  alias %s -> %s\n", alias.Alias, alias.UserID)
+	}
+
+	if len(entries) == 0 && len(subs) == 0 && len(aliases) == 0 {
+		fmt.Println("  no changes")
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/vndee/lensquery-backend/pkg/database"
+	"github.com/vndee/lensquery-backend/pkg/model"
+)
+
+// replayItem is one event to replay with the payload it is recorded under.
+type replayItem struct {
+	Event   model.Event
+	Payload []byte
+}
+
+// filter selects the events to replay. Zero fields match everything.
+type filter struct {
+	Type   string
+	UserID string
+	From   time.Time
+	To     time.Time
+}
+
+func (f filter) match(event *model.Event) bool {
+	if f.Type != "" && event.Type != f.Type {
+		return false
+	}
+
+	if f.UserID != "" && !hasUser(event, f.UserID) {
+		return false
+	}
+
+	at := time.UnixMilli(event.EventTimestampMs)
+	if !f.From.IsZero() && at.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !at.Before(f.To) {
+		return false
+	}
+
+	return true
+}
+
+func hasUser(event *model.Event, userID string) bool {
+	ids := []string{event.AppUserID, event.OriginalAppUserID}
+	ids = append(ids, event.Aliases...)
+	ids = append(ids, event.TransferredFrom...)
+	ids = append(ids, event.TransferredTo...)
+
+	for _, id := range ids {
+		if id == userID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseTime accepts RFC 3339 timestamps and plain UTC dates.
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	return time.Parse("2006-01-02", value)
+}
+
+// loadDatabaseEvents reads stored webhook deliveries, oldest first.
+func loadDatabaseEvents(f filter) ([]replayItem, error) {
+	query := database.Pool.Order("created_at ASC")
+	if f.Type != "" {
+		query = query.Where("type = ?", f.Type)
+	}
+
+	var records []model.WebhookEvent
+	if err := query.Find(&records).Error; err != nil {
+		return nil, err
+	}
+
+	items := []replayItem{}
+	for _, record := range records {
+		payload := model.WebhookPayload{}
+		if err := sonic.Unmarshal([]byte(record.Payload), &payload); err != nil {
+			return nil, fmt.Errorf("webhook event %s: %w", record.ID, err)
+		}
+
+		if f.match(&payload.Event) {
+			items = append(items, replayItem{Event: payload.Event, Payload: []byte(record.Payload)})
+		}
+	}
+
+	return items, nil
+}
+
+// loadFileEvents reads a RevenueCat export: a JSON array or JSON lines of
+// webhook payloads or bare events. Events are replayed in file order.
+func loadFileEvents(path string, f filter) ([]replayItem, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := splitRecords(data)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []replayItem{}
+	for i, record := range records {
+		item, err := parseRecord(record)
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", i+1, err)
+		}
+
+		if f.match(&item.Event) {
+			items = append(items, item)
+		}
+	}
+
+	return items, nil
+}
+
+func splitRecords(data []byte) ([][]byte, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	if data[0] == '[' {
+		var raw []json.RawMessage
+		if err := sonic.Unmarshal(data, &raw); err != nil {
+			return nil, err
+		}
+
+		records := make([][]byte, 0, len(raw))
+		for _, record := range raw {
+			records = append(records, record)
+		}
+		return records, nil
+	}
+
+	records := [][]byte{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			records = append(records, append([]byte(nil), line...))
+		}
+	}
+
+	return records, scanner.Err()
+}
+
+func parseRecord(record []byte) (replayItem, error) {
+	payload := model.WebhookPayload{}
+	if err := sonic.Unmarshal(record, &payload); err != nil {
+		return replayItem{}, err
+	}
+	if payload.Event.ID != "" {
+		return replayItem{Event: payload.Event, Payload: record}, nil
+	}
+
+	// A bare event, stored wrapped like a webhook delivery
+	event := model.Event{}
+	if err := sonic.Unmarshal(record, &event); err != nil {
+		return replayItem{}, err
+	}
+	if event.ID == "" {
+		return replayItem{}, fmt.Errorf("missing event id")
+	}
+
+	wrapped, err := sonic.Marshal(model.WebhookPayload{APIVersion: "1.0", Event: event})
+	if err != nil {
+		return replayItem{}, err
+	}
+
+	return replayItem{Event: event, Payload: wrapped}, nil
+}
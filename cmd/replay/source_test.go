@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeExport(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "export.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFileEvents(t *testing.T) {
+	tests := []struct {
+		description string
+		content     string
+		filter      filter
+		expectedIDs []string
+	}{
+		{
+			description: "array of webhook payloads",
+			content:     `[{"api_version":"1.0","event":{"id":"a","type":"RENEWAL"}},{"api_version":"1.0","event":{"id":"b","type":"EXPIRATION"}}]`,
+			expectedIDs: []string{"a", "b"},
+		},
+		{
+			description: "json lines of bare events",
+			content:     "{\"id\":\"a\",\"type\":\"RENEWAL\"}\n\n{\"id\":\"b\",\"type\":\"EXPIRATION\"}\n",
+			expectedIDs: []string{"a", "b"},
+		},
+		{
+			description: "filter by type",
+			content:     `[{"id":"a","type":"RENEWAL"},{"id":"b","type":"EXPIRATION"}]`,
+			filter:      filter{Type: "EXPIRATION"},
+			expectedIDs: []string{"b"},
+		},
+		{
+			description: "filter by alias",
+			content:     `[{"id":"a","app_user_id":"u1"},{"id":"b","app_user_id":"u2","aliases":["$RCAnonymousID:x"]}]`,
+			filter:      filter{UserID: "$RCAnonymousID:x"},
+			expectedIDs: []string{"b"},
+		},
+		{
+			description: "filter by date range",
+			content:     `[{"id":"a","event_timestamp_ms":1690000000000},{"id":"b","event_timestamp_ms":1700000000000},{"id":"c","event_timestamp_ms":1710000000000}]`,
+			filter:      filter{From: time.UnixMilli(1695000000000), To: time.UnixMilli(1710000000000)},
+			expectedIDs: []string{"b"},
+		},
+	}
+
+	for _, test := range tests {
+		items, err := loadFileEvents(writeExport(t, test.content), test.filter)
+		assert.NoErrorf(t, err, test.description)
+
+		ids := []string{}
+		for _, item := range items {
+			ids = append(ids, item.Event.ID)
+			assert.Equalf(t, item.Event.ID, mustParse(t, item.Payload), test.description)
+		}
+		assert.Equalf(t, test.expectedIDs, ids, test.description)
+	}
+}
+
+func mustParse(t *testing.T, payload []byte) string {
+	item, err := parseRecord(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return item.Event.ID
+}
+
+func TestLoadFileEventsMissingID(t *testing.T) {
+	_, err := loadFileEvents(writeExport(t, `[{"type":"RENEWAL"}]`), filter{})
+	assert.Error(t, err)
+}
+
+func TestParseTime(t *testing.T) {
+	day, err := parseTime("2024-03-01")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), day)
+
+	_, err = parseTime("yesterday")
+	assert.Error(t, err)
+}
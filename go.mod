@@ -11,8 +11,10 @@ require (
 	github.com/gofiber/fiber/v2 v2.48.0
 	github.com/jackc/pgx/v5 v5.4.3
 	github.com/sacsand/gofiber-firebaseauth v1.4.3
+	github.com/sashabaranov/go-openai v1.15.4
 	github.com/shareed2k/go_limiter v0.0.8
 	github.com/stretchr/testify v1.8.4
+	github.com/valyala/fasthttp v1.48.0
 	gorm.io/driver/postgres v1.5.2
 	gorm.io/gorm v1.25.4
 )
@@ -52,10 +54,8 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/rivo/uniseg v0.2.0 // indirect
 	github.com/rogpeppe/go-internal v1.11.0 // indirect
-	github.com/sashabaranov/go-openai v1.15.4 // indirect
 	github.com/twitchyliquid64/golang-asm v0.15.1 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
-	github.com/valyala/fasthttp v1.48.0 // indirect
 	github.com/valyala/tcplisten v1.0.0 // indirect
 	go.opencensus.io v0.24.0 // indirect
 	golang.org/x/arch v0.0.0-20210923205945-b76863e36670 // indirect
@@ -0,0 +1,244 @@
+package appstore
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testChain is a locally generated stand-in for Apple's signing chain.
+type testChain struct {
+	root    *x509.Certificate
+	x5c     []string
+	leafKey *ecdsa.PrivateKey
+}
+
+var asn1Null = []byte{0x05, 0x00}
+
+func newCertificate(t *testing.T, serial int64, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, isCA bool, marker asn1.ObjectIdentifier) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if marker != nil {
+		template.ExtraExtensions = []pkix.Extension{{Id: marker, Value: asn1Null}}
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent, parentKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+
+	certificate, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return certificate, key
+}
+
+func newTestChain(t *testing.T, leafMarker asn1.ObjectIdentifier) testChain {
+	root, rootKey := newCertificate(t, 1, "Test Root CA", nil, nil, true, nil)
+	intermediate, intermediateKey := newCertificate(t, 2, "Test Intermediate", root, rootKey, true, oidIntermediateMarker)
+	leaf, leafKey := newCertificate(t, 3, "Test Leaf", intermediate, intermediateKey, false, leafMarker)
+
+	return testChain{
+		root:    root,
+		leafKey: leafKey,
+		x5c: []string{
+			base64.StdEncoding.EncodeToString(leaf.Raw),
+			base64.StdEncoding.EncodeToString(intermediate.Raw),
+			base64.StdEncoding.EncodeToString(root.Raw),
+		},
+	}
+}
+
+func (chain testChain) verifier() *Verifier {
+	roots := x509.NewCertPool()
+	roots.AddCert(chain.root)
+	return &Verifier{Roots: roots, BundleID: "com.lensquery.app"}
+}
+
+func (chain testChain) sign(t *testing.T, alg string, payload interface{}) string {
+	header, err := sonic.Marshal(jwsHeader{Alg: alg, X5c: chain.x5c})
+	require.NoError(t, err)
+	body, err := sonic.Marshal(payload)
+	require.NoError(t, err)
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, chain.leafKey, digest[:])
+	require.NoError(t, err)
+
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (chain testChain) notification(t *testing.T, notificationType string, subtype string, transaction TransactionInfo, renewal *RenewalInfo) string {
+	payload := NotificationPayload{
+		NotificationType: notificationType,
+		Subtype:          subtype,
+		NotificationUUID: "0b6e5d1c-4a3f-4d8e-9f1a-2c3b4d5e6f70",
+		Version:          "2.0",
+		SignedDate:       1700000000000,
+		Data: NotificationData{
+			BundleID:              "com.lensquery.app",
+			Environment:           "Production",
+			SignedTransactionInfo: chain.sign(t, "ES256", transaction),
+		},
+	}
+	if renewal != nil {
+		payload.Data.SignedRenewalInfo = chain.sign(t, "ES256", renewal)
+	}
+
+	return chain.sign(t, "ES256", payload)
+}
+
+var creditPack = TransactionInfo{
+	TransactionID:         "2000000123",
+	OriginalTransactionID: "2000000123",
+	ProductID:             "lq_credits_10",
+	PurchaseDate:          1699999990000,
+	Price:                 9990,
+	Currency:              "USD",
+	AppAccountToken:       "5f8f3c2e-8a51-4c1e-b8a4-9a1f7c0e2d11",
+}
+
+func TestParseNotification(t *testing.T) {
+	chain := newTestChain(t, oidLeafMarker)
+
+	notification, err := chain.verifier().ParseNotification(chain.notification(t, "ONE_TIME_CHARGE", "", creditPack, nil))
+	require.NoError(t, err)
+	assert.Equal(t, "ONE_TIME_CHARGE", notification.Payload.NotificationType)
+	assert.Equal(t, creditPack, *notification.Transaction)
+	assert.Nil(t, notification.Renewal)
+}
+
+func TestParseNotificationRejected(t *testing.T) {
+	chain := newTestChain(t, oidLeafMarker)
+	signed := chain.notification(t, "ONE_TIME_CHARGE", "", creditPack, nil)
+	parts := strings.Split(signed, ".")
+
+	otherRoot := newTestChain(t, oidLeafMarker)
+	unmarked := newTestChain(t, nil)
+
+	tamperedBody, err := sonic.Marshal(NotificationPayload{NotificationType: "ONE_TIME_CHARGE"})
+	require.NoError(t, err)
+
+	otherBundle := chain.verifier()
+	otherBundle.BundleID = "com.example.other"
+
+	expired := chain.verifier()
+	expired.now = func() time.Time { return time.Now().Add(48 * time.Hour) }
+
+	tests := []struct {
+		description string
+		verifier    *Verifier
+		payload     string
+		expected    error
+	}{
+		{"not a JWS", chain.verifier(), "abc.def", ErrMalformedJWS},
+		{"unsupported algorithm", chain.verifier(), chain.sign(t, "HS256", creditPack), ErrUnsupportedAlg},
+		{"chain from another root", otherRoot.verifier(), signed, ErrInvalidChain},
+		{"leaf without Apple marker", unmarked.verifier(), unmarked.notification(t, "ONE_TIME_CHARGE", "", creditPack, nil), ErrInvalidChain},
+		{"expired chain", expired, signed, ErrInvalidChain},
+		{"no roots configured", &Verifier{}, signed, ErrInvalidChain},
+		{"tampered payload", chain.verifier(), parts[0] + "." + base64.RawURLEncoding.EncodeToString(tamperedBody) + "." + parts[2], ErrInvalidSignature},
+		{"signed by another key", chain.verifier(), parts[0] + "." + parts[1] + "." + strings.Split(otherRoot.sign(t, "ES256", creditPack), ".")[2], ErrInvalidSignature},
+		{"another bundle", otherBundle, signed, ErrBundleMismatch},
+	}
+
+	for _, test := range tests {
+		_, err := test.verifier.ParseNotification(test.payload)
+		assert.ErrorIsf(t, err, test.expected, test.description)
+	}
+}
+
+func TestToEvent(t *testing.T) {
+	subscriptionTransaction := TransactionInfo{
+		TransactionID:         "2000000456",
+		OriginalTransactionID: "2000000400",
+		ProductID:             "lq_standard_plan",
+		PurchaseDate:          1700000000000,
+		ExpiresDate:           1702592000000,
+		Price:                 4990,
+		Currency:              "EUR",
+	}
+	renewal := &RenewalInfo{AutoRenewProductID: "lq_premium_plan", GracePeriodExpiresDate: 1703196800000}
+
+	tests := []struct {
+		description      string
+		notificationType string
+		subtype          string
+		transaction      TransactionInfo
+		expectedType     string
+		expectedReason   string
+		expectedNew      string
+		expectedPrice    float64
+	}{
+		{"credit pack", "ONE_TIME_CHARGE", "", creditPack, "NON_RENEWING_PURCHASE", "", "", 9.99},
+		{"refund", "REFUND", "", creditPack, "CANCELLATION", "CUSTOMER_SUPPORT", "", -9.99},
+		{"new subscription", "SUBSCRIBED", "INITIAL_BUY", subscriptionTransaction, "INITIAL_PURCHASE", "", "", 0},
+		{"renewal", "DID_RENEW", "", subscriptionTransaction, "RENEWAL", "", "", 0},
+		{"auto-renew off", "DID_CHANGE_RENEWAL_STATUS", "AUTO_RENEW_DISABLED", subscriptionTransaction, "CANCELLATION", "UNSUBSCRIBE", "", 0},
+		{"auto-renew on", "DID_CHANGE_RENEWAL_STATUS", "AUTO_RENEW_ENABLED", subscriptionTransaction, "UNCANCELLATION", "UNSUBSCRIBE", "", 0},
+		{"upgrade", "DID_CHANGE_RENEWAL_PREF", "UPGRADE", subscriptionTransaction, "PRODUCT_CHANGE", "", "lq_premium_plan", 0},
+		{"billing issue", "DID_FAIL_TO_RENEW", "GRACE_PERIOD", subscriptionTransaction, "BILLING_ISSUE", "", "", 0},
+		{"expired", "EXPIRED", "VOLUNTARY", subscriptionTransaction, "EXPIRATION", "", "", 0},
+		{"extended", "RENEWAL_EXTENDED", "", subscriptionTransaction, "SUBSCRIPTION_EXTENDED", "", "", 0},
+	}
+
+	chain := newTestChain(t, oidLeafMarker)
+	for _, test := range tests {
+		notification, err := chain.verifier().ParseNotification(chain.notification(t, test.notificationType, test.subtype, test.transaction, renewal))
+		require.NoErrorf(t, err, test.description)
+
+		event, ok := ToEvent(notification)
+		assert.Truef(t, ok, test.description)
+		assert.Equalf(t, test.expectedType, event.Type, test.description)
+		assert.Equalf(t, test.expectedReason, event.CancelReason, test.description)
+		assert.Equalf(t, test.expectedNew, event.NewProductID, test.description)
+		assert.InDeltaf(t, test.expectedPrice, event.Price, 1e-9, test.description)
+		assert.Equalf(t, Store, event.Store, test.description)
+		assert.Equalf(t, "PRODUCTION", event.Environment, test.description)
+		assert.Equalf(t, test.transaction.TransactionID, event.TransactionID, test.description)
+		assert.Equalf(t, test.transaction.ProductID, event.ProductID, test.description)
+		assert.Equalf(t, int64(1703196800000), event.GracePeriodExpirationAtMs, test.description)
+	}
+}
+
+func TestToEventUnsupported(t *testing.T) {
+	notification := &Notification{Payload: NotificationPayload{NotificationType: "CONSUMPTION_REQUEST"}}
+	_, ok := ToEvent(notification)
+	assert.False(t, ok)
+
+	// Only notifications about a transaction can be applied
+	notification = &Notification{Payload: NotificationPayload{NotificationType: "DID_RENEW"}}
+	_, ok = ToEvent(notification)
+	assert.False(t, ok)
+}
@@ -0,0 +1,172 @@
+package appstore
+
+import (
+	"github.com/vndee/lensquery-backend/pkg/config"
+	"github.com/vndee/lensquery-backend/pkg/model"
+	"github.com/vndee/lensquery-backend/pkg/subscription"
+)
+
+// Store is the store name RevenueCat uses for the App Store, and the key of
+// its products in packages.json.
+const Store = "APP_STORE"
+
+// ResponseBodyV2 is the body Apple posts to the notification endpoint.
+type ResponseBodyV2 struct {
+	SignedPayload string `json:"signedPayload"`
+}
+
+type NotificationPayload struct {
+	NotificationType string           `json:"notificationType"`
+	Subtype          string           `json:"subtype"`
+	NotificationUUID string           `json:"notificationUUID"`
+	Data             NotificationData `json:"data"`
+	Version          string           `json:"version"`
+	SignedDate       int64            `json:"signedDate"`
+}
+
+type NotificationData struct {
+	AppAppleID            int64  `json:"appAppleId"`
+	BundleID              string `json:"bundleId"`
+	BundleVersion         string `json:"bundleVersion"`
+	Environment           string `json:"environment"`
+	SignedTransactionInfo string `json:"signedTransactionInfo"`
+	SignedRenewalInfo     string `json:"signedRenewalInfo"`
+}
+
+type TransactionInfo struct {
+	AppAccountToken       string `json:"appAccountToken"`
+	BundleID              string `json:"bundleId"`
+	Currency              string `json:"currency"`
+	Environment           string `json:"environment"`
+	ExpiresDate           int64  `json:"expiresDate"`
+	OriginalTransactionID string `json:"originalTransactionId"`
+	Price                 int64  `json:"price"`
+	ProductID             string `json:"productId"`
+	PurchaseDate          int64  `json:"purchaseDate"`
+	RevocationDate        int64  `json:"revocationDate"`
+	SignedDate            int64  `json:"signedDate"`
+	Storefront            string `json:"storefront"`
+	TransactionID         string `json:"transactionId"`
+	Type                  string `json:"type"`
+}
+
+type RenewalInfo struct {
+	AutoRenewProductID     string `json:"autoRenewProductId"`
+	AutoRenewStatus        int    `json:"autoRenewStatus"`
+	ExpirationIntent       int    `json:"expirationIntent"`
+	GracePeriodExpiresDate int64  `json:"gracePeriodExpiresDate"`
+	OriginalTransactionID  string `json:"originalTransactionId"`
+	ProductID              string `json:"productId"`
+	RenewalDate            int64  `json:"renewalDate"`
+}
+
+// Notification is a verified notification with its decoded transaction and
+// renewal info, either of which Apple may leave out.
+type Notification struct {
+	Payload     NotificationPayload
+	Transaction *TransactionInfo
+	Renewal     *RenewalInfo
+}
+
+// cancelReasonUnsubscribe is the cancel_reason RevenueCat reports when the
+// user turns off auto-renewal.
+const cancelReasonUnsubscribe = "UNSUBSCRIBE"
+
+// eventType maps a notification type and subtype onto the RevenueCat event
+// type with the same effect, or "" when there is none.
+func eventType(notificationType string, subtype string) string {
+	switch notificationType {
+	case "TEST":
+		return "TEST"
+	case "SUBSCRIBED":
+		return "INITIAL_PURCHASE"
+	case "DID_RENEW":
+		return "RENEWAL"
+	case "ONE_TIME_CHARGE":
+		return "NON_RENEWING_PURCHASE"
+	case "DID_CHANGE_RENEWAL_STATUS":
+		if subtype == "AUTO_RENEW_ENABLED" {
+			return "UNCANCELLATION"
+		}
+		return "CANCELLATION"
+	case "DID_CHANGE_RENEWAL_PREF":
+		if subtype == "" {
+			return ""
+		}
+		return "PRODUCT_CHANGE"
+	case "DID_FAIL_TO_RENEW":
+		return "BILLING_ISSUE"
+	case "EXPIRED", "GRACE_PERIOD_EXPIRED", "REVOKE":
+		return "EXPIRATION"
+	case "REFUND":
+		return "CANCELLATION"
+	case "RENEWAL_EXTENDED":
+		return "SUBSCRIPTION_EXTENDED"
+	}
+
+	return ""
+}
+
+// ToEvent maps the notification onto a RevenueCat event for the App Store,
+// leaving AppUserID to the caller. It reports false for notifications with no
+// effect on credits or subscriptions.
+func ToEvent(notification *Notification) (model.Event, bool) {
+	payload := notification.Payload
+	event := model.Event{
+		ID:               payload.NotificationUUID,
+		Type:             eventType(payload.NotificationType, payload.Subtype),
+		Store:            Store,
+		Environment:      environment(payload.Data.Environment),
+		EventTimestampMs: payload.SignedDate,
+	}
+	if event.Type == "" {
+		return event, false
+	}
+	if event.Type == "TEST" {
+		return event, true
+	}
+
+	transaction := notification.Transaction
+	if transaction == nil {
+		return event, false
+	}
+
+	event.TransactionID = transaction.TransactionID
+	event.OriginalTransactionID = transaction.OriginalTransactionID
+	event.ProductID = transaction.ProductID
+	event.PurchasedAtMs = transaction.PurchaseDate
+	event.ExpirationAtMs = transaction.ExpiresDate
+	event.Currency = transaction.Currency
+
+	// Apple reports prices in milliunits of the purchase currency
+	event.PriceInPurchasedCurrency = float64(transaction.Price) / 1000
+	if transaction.Currency == "USD" {
+		event.Price = event.PriceInPurchasedCurrency
+	}
+
+	switch payload.NotificationType {
+	case "DID_CHANGE_RENEWAL_STATUS":
+		event.CancelReason = cancelReasonUnsubscribe
+	case "REFUND":
+		event.CancelReason = subscription.CancelReasonRefund
+		event.Price = -event.Price
+	}
+
+	if renewal := notification.Renewal; renewal != nil {
+		event.GracePeriodExpirationAtMs = renewal.GracePeriodExpiresDate
+		if event.Type == "PRODUCT_CHANGE" {
+			event.NewProductID = renewal.AutoRenewProductID
+		}
+	}
+
+	return event, true
+}
+
+// environment maps Apple's Production, Sandbox and Xcode environments.
+func environment(appleEnvironment string) string {
+	if appleEnvironment == "Production" {
+		return config.EnvironmentProduction
+	}
+
+	return config.EnvironmentSandbox
+}
@@ -0,0 +1,186 @@
+// Package appstore verifies App Store Server Notifications v2 and maps them
+// onto the RevenueCat-shaped events the webhook handlers already apply.
+package appstore
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+var (
+	ErrMalformedJWS     = errors.New("malformed JWS")
+	ErrUnsupportedAlg   = errors.New("unsupported JWS algorithm")
+	ErrInvalidChain     = errors.New("invalid certificate chain")
+	ErrInvalidSignature = errors.New("invalid JWS signature")
+	ErrBundleMismatch   = errors.New("notification for another bundle")
+)
+
+// Apple marks the certificates it signs App Store payloads with using these
+// extensions.
+var (
+	oidLeafMarker         = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 11, 1}
+	oidIntermediateMarker = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 2, 1}
+)
+
+// Verifier checks signed App Store payloads against Roots, normally Apple
+// Root CA - G3. BundleID, when set, must match the notification's bundle.
+type Verifier struct {
+	Roots    *x509.CertPool
+	BundleID string
+
+	// now is overridden by tests
+	now func() time.Time
+}
+
+type jwsHeader struct {
+	Alg string   `json:"alg"`
+	X5c []string `json:"x5c"`
+}
+
+// ParseNotification verifies the notification and the transaction and
+// renewal info signed inside it.
+func (v *Verifier) ParseNotification(signedPayload string) (*Notification, error) {
+	notification := Notification{}
+	if err := v.verify(signedPayload, &notification.Payload); err != nil {
+		return nil, err
+	}
+
+	data := notification.Payload.Data
+	if v.BundleID != "" && data.BundleID != v.BundleID {
+		return nil, ErrBundleMismatch
+	}
+
+	if data.SignedTransactionInfo != "" {
+		notification.Transaction = &TransactionInfo{}
+		if err := v.verify(data.SignedTransactionInfo, notification.Transaction); err != nil {
+			return nil, fmt.Errorf("transaction info: %w", err)
+		}
+	}
+
+	if data.SignedRenewalInfo != "" {
+		notification.Renewal = &RenewalInfo{}
+		if err := v.verify(data.SignedRenewalInfo, notification.Renewal); err != nil {
+			return nil, fmt.Errorf("renewal info: %w", err)
+		}
+	}
+
+	return &notification, nil
+}
+
+// verify checks an ES256 compact JWS whose x5c chain leads to one of the
+// roots, and decodes its payload into v.
+func (v *Verifier) verify(token string, payload interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrMalformedJWS
+	}
+
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return ErrMalformedJWS
+	}
+
+	header := jwsHeader{}
+	if err := sonic.Unmarshal(rawHeader, &header); err != nil {
+		return ErrMalformedJWS
+	}
+	if header.Alg != "ES256" {
+		return ErrUnsupportedAlg
+	}
+
+	leaf, err := v.verifyChain(header.X5c)
+	if err != nil {
+		return err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(signature) != 64 {
+		return ErrInvalidSignature
+	}
+
+	publicKey, ok := leaf.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return ErrInvalidSignature
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(publicKey, digest[:], r, s) {
+		return ErrInvalidSignature
+	}
+
+	rawPayload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ErrMalformedJWS
+	}
+
+	return sonic.Unmarshal(rawPayload, payload)
+}
+
+// verifyChain checks the x5c leaf and intermediate against the roots and
+// returns the leaf.
+func (v *Verifier) verifyChain(x5c []string) (*x509.Certificate, error) {
+	if v.Roots == nil || len(x5c) < 2 {
+		return nil, ErrInvalidChain
+	}
+
+	certificates := make([]*x509.Certificate, 0, len(x5c))
+	for _, encoded := range x5c {
+		der, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, ErrInvalidChain
+		}
+
+		certificate, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, ErrInvalidChain
+		}
+		certificates = append(certificates, certificate)
+	}
+
+	leaf, intermediate := certificates[0], certificates[1]
+	if !hasExtension(leaf, oidLeafMarker) || !hasExtension(intermediate, oidIntermediateMarker) {
+		return nil, ErrInvalidChain
+	}
+
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(intermediate)
+
+	now := time.Now
+	if v.now != nil {
+		now = v.now
+	}
+
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         v.Roots,
+		Intermediates: intermediates,
+		CurrentTime:   now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidChain, err)
+	}
+
+	return leaf, nil
+}
+
+func hasExtension(certificate *x509.Certificate, oid asn1.ObjectIdentifier) bool {
+	for _, extension := range certificate.Extensions {
+		if extension.Id.Equal(oid) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,52 @@
+package config
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// AppleRootCAs verifies App Store Server Notifications. It stays nil, and the
+// endpoint disabled, unless APPLE_ROOT_CA_PATH names a PEM or DER root such
+// as Apple Root CA - G3.
+var AppleRootCAs *x509.CertPool
+
+// AppleBundleID, when set, is the only bundle notifications are accepted for.
+var AppleBundleID = os.Getenv("APPLE_BUNDLE_ID")
+
+func LoadAppleRootCAs() error {
+	path := os.Getenv("APPLE_ROOT_CA_PATH")
+	if path == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	pool, err := parseCertificates(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	AppleRootCAs = pool
+	return nil
+}
+
+// parseCertificates reads one or more PEM certificates, or a single DER one.
+func parseCertificates(data []byte) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if pool.AppendCertsFromPEM(data) {
+		return pool, nil
+	}
+
+	certificate, err := x509.ParseCertificate(data)
+	if err != nil {
+		return nil, err
+	}
+
+	pool.AddCert(certificate)
+	return pool, nil
+}
@@ -25,8 +25,71 @@ const (
 	OpenRouterAPIKey   = "no-key"
 
 	// Pricing
-	PriceAdjustFactor     = 1.1
-	MinPrice              = 0.001
 	FreeTextSnapPrice     = 0.01
 	EquationTextSnapPrice = 0.02
+	PricingReloadInterval = 30 * time.Second
+
+	// Credit holds
+	ChatHoldTTL            = 10 * time.Minute
+	SnapHoldTTL            = 2 * time.Minute
+	LedgerSweepInterval    = time.Minute
+	DefaultChatMaxTokens   = 1024
+	ModelPricingCacheTTL   = 10 * time.Minute
+	ModelPricingTimeout    = 10 * time.Second
+	EstimatedCharsPerToken = 4
+
+	// Credit history
+	CreditHistoryPageSize    = 20
+	CreditHistoryMaxPageSize = 100
+
+	// Promo codes
+	PromoLimiterRate   = 10
+	PromoLimiterBurst  = 1
+	PromoLimiterPeriod = 10 * time.Minute
+
+	// Subscriptions
+	BillingGracePeriod    = 7 * 24 * time.Hour
+	RefundReviewThreshold = 2
+
+	// Plan entitlements
+	DefaultChatModel     = "openai/gpt-3.5-turbo"
+	BasicChatMaxMessages = 1
+
+	// Referral program
+	ReferrerBonusCredits = 0.1
+	RefereeBonusCredits  = 0.05
+	ReferralRewardCap    = 20
+	ReferralCodeLength   = 8
+
+	// Admin
+	AdminClaim          = "admin"
+	AdminLedgerPageSize = 50
+
+	// Chat receipt reconciliation
+	ReconcileHourUTC    = 3
+	ReconcileMinAge     = time.Hour
+	ReconcileMaxAge     = 7 * 24 * time.Hour
+	ReconcileReportSize = 20
+
+	// Background queues
+	QueuePollInterval   = time.Second
+	QueueMaxAttempts    = 8
+	QueueRetryBaseDelay = 10 * time.Second
+	QueueRetryMaxDelay  = time.Hour
+
+	// A job running longer than its lease is taken for abandoned and queued again
+	QueueLeaseTimeout = 5 * time.Minute
+
+	// Webhook events stuck unprocessed longer than this are queued again
+	WebhookStuckTimeout  = 15 * time.Minute
+	WebhookSweepInterval = 5 * time.Minute
+
+	// Idempotency
+	IdempotencyKeyTTL     = 24 * time.Hour
+	IdempotencyLockTTL    = 10 * time.Minute
+	IdempotencyKeyMaxSize = 255
 )
+
+// LowBalanceThresholds are the balances, in credits, at or below which a user
+// is emailed once per crossing. A threshold of 0 sends the out-of-credits email.
+var LowBalanceThresholds = []float64{0.05, 0.02, 0}
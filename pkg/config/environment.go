@@ -0,0 +1,59 @@
+package config
+
+import (
+	"os"
+	"strings"
+)
+
+// RevenueCat environments
+const (
+	EnvironmentProduction = "PRODUCTION"
+	EnvironmentSandbox    = "SANDBOX"
+)
+
+// SandboxTesterUIDs are the users whose sandbox purchases are applied, read
+// from the comma-separated SANDBOX_TESTER_UIDS. Sandbox events for anyone
+// else are recorded but ignored.
+var SandboxTesterUIDs = parseUIDList(os.Getenv("SANDBOX_TESTER_UIDS"))
+
+// TrustedProxies are the load balancers, from the comma-separated
+// TRUSTED_PROXIES, whose X-Forwarded-For header gives the client IP. Requests
+// from anywhere else are attributed to their remote address.
+var TrustedProxies = parseList(os.Getenv("TRUSTED_PROXIES"))
+
+func parseList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func parseUIDList(value string) map[string]bool {
+	uids := map[string]bool{}
+	for _, uid := range strings.Split(value, ",") {
+		if uid = strings.TrimSpace(uid); uid != "" {
+			uids[uid] = true
+		}
+	}
+
+	return uids
+}
+
+// IsSandboxTester reports whether the user may receive sandbox purchases.
+func IsSandboxTester(userID string) bool {
+	return SandboxTesterUIDs[userID]
+}
+
+// NormalizeEnvironment maps an empty environment to production, the only one
+// RevenueCat omitted it for.
+func NormalizeEnvironment(environment string) string {
+	if environment == "" {
+		return EnvironmentProduction
+	}
+
+	return environment
+}
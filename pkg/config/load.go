@@ -12,6 +12,37 @@ type Plan struct {
 	FullChatExperience bool   `json:"FullChatExperience"`
 	TextOCRSnap        int    `json:"TextOCRSnap"`
 	Name               string `json:"name"`
+
+	// PayPerUse plans have no snap quotas, every use is billed in credits
+	PayPerUse bool `json:"-"`
+}
+
+// Outranks reports whether p is a higher tier than other.
+func (p Plan) Outranks(other Plan) bool {
+	if p.EquationOCRSnap != other.EquationOCRSnap {
+		return p.EquationOCRSnap > other.EquationOCRSnap
+	}
+
+	return p.TextOCRSnap > other.TextOCRSnap
+}
+
+// FreePlan applies to users with neither an active subscription nor
+// purchased credits.
+var FreePlan = Plan{
+	CustomLLMProvider:  false,
+	EquationOCRSnap:    TrialFreeEquationCredits,
+	FullChatExperience: false,
+	TextOCRSnap:        TrialFreeTextSnapCredits,
+	Name:               "Free Plan",
+}
+
+// CreditPackPlan applies to users without a subscription who hold purchased
+// credits: they pay for each use, so nothing is gated.
+var CreditPackPlan = Plan{
+	CustomLLMProvider:  true,
+	FullChatExperience: true,
+	Name:               "Credit Pack",
+	PayPerUse:          true,
 }
 
 var StorePackages *map[string]map[string]int32
@@ -73,3 +104,18 @@ func LoadStorePackagesConfig() error {
 
 	return nil
 }
+
+// GetPlan looks up a subscription product of the given store.
+func GetPlan(store string, productID string) (Plan, bool) {
+	var plan Plan
+	var ok bool
+
+	switch store {
+	case "APP_STORE":
+		plan, ok = AppStorePlanConfigs[productID]
+	case "PLAY_STORE":
+		plan, ok = PlayStorePlanConfigs[productID]
+	}
+
+	return plan, ok
+}
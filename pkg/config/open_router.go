@@ -1,6 +1,8 @@
 package config
 
 import (
+	"fmt"
+	"io/ioutil"
 	"net/http"
 
 	openai "github.com/sashabaranov/go-openai"
@@ -29,3 +31,25 @@ func SetupOpenRouterClient() {
 
 	OpenRouterClient = openai.NewClientWithConfig(config)
 }
+
+// FetchGeneration returns the raw OpenRouter stats of a finished generation.
+func FetchGeneration(id string) ([]byte, error) {
+	url := fmt.Sprintf("%s/generation?id=%s", OpenRouterEndpoint, id)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", OpenRouterAPIKey))
+	req.Header.Set("HTTP-Referer", "https://lensquery.com/")
+	req.Header.Set("X-Title", "LensQuery")
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
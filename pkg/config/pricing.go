@@ -0,0 +1,176 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+const PricingCatalogPath = "./pkg/config/pricing.json"
+
+// ModelPrice is what end users pay for a model. Zero fields fall back to the
+// catalog default. PromptPrice and CompletionPrice are per-token overrides
+// that replace the marked-up OpenRouter price; they are set as a pair or not
+// at all.
+type ModelPrice struct {
+	Markup          float64 `json:"markup"`
+	MinCharge       float64 `json:"min_charge"`
+	PromptPrice     float64 `json:"prompt_price"`
+	CompletionPrice float64 `json:"completion_price"`
+	Disabled        bool    `json:"disabled"`
+}
+
+type PricingCatalog struct {
+	Default ModelPrice            `json:"default"`
+	Models  map[string]ModelPrice `json:"models"`
+}
+
+var (
+	pricingMutex      sync.RWMutex
+	pricingCatalog    *PricingCatalog
+	pricingModifiedAt time.Time
+)
+
+func LoadPricingCatalog() error {
+	info, err := os.Stat(PricingCatalogPath)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(PricingCatalogPath)
+	if err != nil {
+		return err
+	}
+
+	catalog := &PricingCatalog{}
+	err = sonic.Unmarshal(data, catalog)
+	if err != nil {
+		return err
+	}
+
+	if err := catalog.Default.validate(); err != nil {
+		return fmt.Errorf("default price: %w", err)
+	}
+	for modelID, price := range catalog.Models {
+		if err := price.validate(); err != nil {
+			return fmt.Errorf("price of %s: %w", modelID, err)
+		}
+	}
+
+	pricingMutex.Lock()
+	pricingCatalog = catalog
+	pricingModifiedAt = info.ModTime()
+	pricingMutex.Unlock()
+
+	return nil
+}
+
+// WatchPricingCatalog reloads the catalog whenever the file changes on disk.
+// A broken file keeps the previously loaded catalog in place.
+func WatchPricingCatalog(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			info, err := os.Stat(PricingCatalogPath)
+			if err != nil {
+				log.Println("[Pricing] Stat catalog:", err)
+				continue
+			}
+
+			pricingMutex.RLock()
+			modified := info.ModTime().After(pricingModifiedAt)
+			pricingMutex.RUnlock()
+
+			if !modified {
+				continue
+			}
+
+			if err := LoadPricingCatalog(); err != nil {
+				log.Println("[Pricing] Reload catalog:", err)
+			} else {
+				log.Println("[Pricing] Catalog reloaded")
+			}
+		}
+	}()
+}
+
+func DefaultModelPrice() ModelPrice {
+	pricingMutex.RLock()
+	defer pricingMutex.RUnlock()
+
+	return pricingCatalog.Default
+}
+
+func GetModelPrice(modelID string) ModelPrice {
+	pricingMutex.RLock()
+	defer pricingMutex.RUnlock()
+
+	price := pricingCatalog.Default
+	override, ok := pricingCatalog.Models[modelID]
+	if !ok {
+		return price
+	}
+
+	if override.Markup > 0 {
+		price.Markup = override.Markup
+	}
+	if override.MinCharge > 0 {
+		price.MinCharge = override.MinCharge
+	}
+	if override.PromptPrice > 0 {
+		price.PromptPrice = override.PromptPrice
+	}
+	if override.CompletionPrice > 0 {
+		price.CompletionPrice = override.CompletionPrice
+	}
+	price.Disabled = override.Disabled
+
+	return price
+}
+
+// validate rejects a token override missing one of its two prices, which
+// would otherwise be silently ignored.
+func (p ModelPrice) validate() error {
+	if (p.PromptPrice > 0) != (p.CompletionPrice > 0) {
+		return fmt.Errorf("prompt_price and completion_price must be set together")
+	}
+
+	return nil
+}
+
+func (p ModelPrice) hasTokenOverride() bool {
+	return p.PromptPrice > 0 && p.CompletionPrice > 0
+}
+
+// TokenPrices converts OpenRouter's per-token prices into end-user prices.
+func (p ModelPrice) TokenPrices(promptPrice float64, completionPrice float64) (float64, float64) {
+	if p.hasTokenOverride() {
+		return p.PromptPrice, p.CompletionPrice
+	}
+
+	return promptPrice * p.Markup, completionPrice * p.Markup
+}
+
+// Charge prices a finished generation. Usage is OpenRouter's cost in USD;
+// when per-token overrides are set the token counts are billed instead.
+func (p ModelPrice) Charge(usage float64, promptTokens float64, completionTokens float64) float64 {
+	var charge float64
+	if p.hasTokenOverride() {
+		charge = promptTokens*p.PromptPrice + completionTokens*p.CompletionPrice
+	} else {
+		charge = usage * p.Markup
+	}
+
+	if charge < p.MinCharge {
+		charge = p.MinCharge
+	}
+
+	return charge
+}
@@ -0,0 +1,40 @@
+package database
+
+import (
+	"context"
+)
+
+// Advisory lock keys, so jobs running in every process run in one at a time
+const (
+	LockMicroCreditMigration int64 = 7100
+	LockReconciliation       int64 = 7101
+	LockLedgerMigration      int64 = 7102
+)
+
+// TryAdvisoryLock runs fn while holding the session advisory lock key and
+// reports whether it ran; it does not wait when another session holds it.
+func TryAdvisoryLock(key int64, fn func() error) (bool, error) {
+	sqlDB, err := Pool.DB()
+	if err != nil {
+		return false, err
+	}
+
+	// Session locks belong to a connection, so keep one for the whole run
+	ctx := context.Background()
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&locked); err != nil {
+		return false, err
+	}
+	if !locked {
+		return false, nil
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", key)
+
+	return true, fn()
+}
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"fmt"
 	"log"
 	"time"
 
@@ -52,10 +53,181 @@ func GetCloudSQLDB() error {
 }
 
 func CreateTables() {
+	// Must run before AutoMigrate, which would cast the old columns unscaled
+	migrateCreditColumnsToMicroCredits()
+
 	Pool.AutoMigrate(&model.UserCredits{})
 	Pool.AutoMigrate(&model.CreditUsageHistory{})
 	Pool.AutoMigrate(&model.UserTrialData{})
 	Pool.AutoMigrate(&model.Receipt{})
+	Pool.AutoMigrate(&model.LedgerEntry{})
+	Pool.AutoMigrate(&model.CreditHold{})
+	Pool.AutoMigrate(&model.CreditBucket{})
+	Pool.AutoMigrate(&model.PromoCode{})
+	Pool.AutoMigrate(&model.PromoRedemption{})
+	Pool.AutoMigrate(&model.ReferralCode{})
+	Pool.AutoMigrate(&model.Referral{})
+	Pool.AutoMigrate(&model.AuditLog{})
+	Pool.AutoMigrate(&model.CreditAdjustment{})
+	Pool.AutoMigrate(&model.SpendingLimit{})
+	Pool.AutoMigrate(&model.BalanceAlert{})
+	Pool.AutoMigrate(&model.NotificationPreference{})
+	Pool.AutoMigrate(&model.ReconciliationReport{})
+	Pool.AutoMigrate(&model.ReconciliationDiscrepancy{})
+	Pool.AutoMigrate(&model.WebhookEvent{})
+	Pool.AutoMigrate(&model.Subscription{})
+	Pool.AutoMigrate(&model.AccountFlag{})
+	Pool.AutoMigrate(&model.AccountAlias{})
+
+	// App Store notifications look up earlier events of the same purchase
+	err := Pool.Exec(`CREATE INDEX IF NOT EXISTS idx_webhook_events_original_transaction_id
+		ON webhook_events ((payload::jsonb->'event'->>'original_transaction_id'))`).Error
+	if err != nil {
+		log.Printf("Error on indexing webhook events: %v", err)
+	}
+
+	migrateLegacyBalances()
+}
+
+// creditColumns lists every column holding a model.Credits amount.
+var creditColumns = []struct{ table, column string }{
+	{"user_credits", "credit_amount"},
+	{"credit_usage_histories", "amount"},
+	{"receipts", "usage"},
+	{"ledger_entries", "amount"},
+	{"ledger_entries", "balance_after"},
+	{"credit_holds", "amount"},
+	{"credit_buckets", "granted"},
+	{"credit_buckets", "remaining"},
+	{"promo_codes", "amount"},
+	{"promo_redemptions", "amount"},
+	{"credit_adjustments", "amount"},
+}
+
+// migrateCreditColumnsToMicroCredits converts credit columns still stored as
+// floating point credits into integer micro-credits.
+func migrateCreditColumnsToMicroCredits() {
+	// Every process runs this on startup; the lock makes the others wait and
+	// then find the columns already converted instead of scaling them twice
+	err := Pool.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", LockMicroCreditMigration).Error; err != nil {
+			return err
+		}
+
+		for _, c := range creditColumns {
+			var dataType string
+			err := tx.Raw(`SELECT data_type FROM information_schema.columns
+				WHERE table_schema = CURRENT_SCHEMA() AND table_name = ? AND column_name = ?`, c.table, c.column).Scan(&dataType).Error
+			if err != nil {
+				return fmt.Errorf("inspecting %s.%s: %w", c.table, c.column, err)
+			}
+
+			if dataType != "double precision" && dataType != "real" && dataType != "numeric" {
+				continue
+			}
+
+			err = tx.Exec(fmt.Sprintf(`ALTER TABLE %q ALTER COLUMN %q TYPE bigint USING ROUND(%q::numeric * %d)::bigint`,
+				c.table, c.column, c.column, model.MicroCreditsPerCredit)).Error
+			if err != nil {
+				return fmt.Errorf("migrating %s.%s to micro-credits: %w", c.table, c.column, err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Error on migrating credit columns: %v", err)
+	}
+}
+
+// migrateLegacyBalances brings balances that predate the ledger into it. Every
+// process runs this on startup; the lock makes the others wait and then find
+// nothing left to migrate.
+func migrateLegacyBalances() {
+	err := Pool.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", LockLedgerMigration).Error; err != nil {
+			return err
+		}
+
+		if err := migrateOpeningBalances(tx); err != nil {
+			return fmt.Errorf("posting opening balances: %w", err)
+		}
+
+		if err := migrateLegacyCreditBuckets(tx); err != nil {
+			return fmt.Errorf("migrating legacy credit buckets: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Error on migrating legacy balances: %v", err)
+	}
+}
+
+// migrateOpeningBalances posts an OPENING_BALANCE ledger entry for every
+// balance that predates the ledger, so the balance derived from the ledger
+// matches user_credits.credit_amount. The entry is dated just before the
+// user's first ledger entry, which keeps the running sum in step with the
+// balance_after of every later entry. Entries are keyed on the user ID, so
+// posting them again is a no-op.
+func migrateOpeningBalances(tx *gorm.DB) error {
+	// Only rows older than the first ledger entry can hold pre-ledger credits
+	return tx.Exec(`
+		WITH derived AS (
+			SELECT c.user_id,
+				c.credit_amount - COALESCE(SUM(CASE WHEN e.credit_account = 'user:' || c.user_id THEN e.amount ELSE -e.amount END), 0) AS opening,
+				MIN(e.created_at) AS first_entry_at
+			FROM user_credits c
+			LEFT JOIN ledger_entries e ON e.user_id = c.user_id
+			WHERE c.deleted_at IS NULL
+			AND c.created_at <= COALESCE((SELECT MIN(created_at) FROM ledger_entries WHERE entry_type <> 'OPENING_BALANCE'), 'infinity')
+			AND NOT EXISTS (
+				SELECT 1 FROM ledger_entries o
+				WHERE o.entry_type = 'OPENING_BALANCE' AND o.source_type = 'USER_CREDITS' AND o.source_id = c.user_id)
+			GROUP BY c.user_id, c.credit_amount
+		)
+		INSERT INTO ledger_entries (created_at, user_id, entry_type, debit_account, credit_account, amount, balance_after, source_type, source_id, memo)
+		SELECT COALESCE(d.first_entry_at - INTERVAL '1 microsecond', NOW()), d.user_id, 'OPENING_BALANCE',
+			CASE WHEN d.opening > 0 THEN 'system:opening' ELSE 'user:' || d.user_id END,
+			CASE WHEN d.opening > 0 THEN 'user:' || d.user_id ELSE 'system:opening' END,
+			ABS(d.opening), d.opening, 'USER_CREDITS', d.user_id, 'Balance before the ledger'
+		FROM derived d
+		WHERE d.opening <> 0
+		ON CONFLICT (entry_type, source_type, source_id) DO NOTHING`).Error
+}
+
+// migrateLegacyCreditBuckets moves opening balances into a never-expiring
+// purchased bucket linked to their ledger entry, so charges have something to
+// draw from. The unique index on ledger_entry_id keeps it to one bucket per
+// entry however often this runs.
+func migrateLegacyCreditBuckets(tx *gorm.DB) error {
+	// Earlier versions created the bucket without linking it; adopt it rather
+	// than granting the same credits twice
+	err := tx.Exec(`
+		UPDATE credit_buckets b SET ledger_entry_id = e.id, updated_at = NOW()
+		FROM ledger_entries e
+		WHERE b.ledger_entry_id = 0 AND b.kind = 'purchased' AND b.deleted_at IS NULL
+		AND e.entry_type = 'OPENING_BALANCE' AND e.source_type = 'USER_CREDITS' AND e.source_id = b.user_id
+		AND b.id = (SELECT MIN(l.id) FROM credit_buckets l WHERE l.user_id = b.user_id AND l.ledger_entry_id = 0 AND l.kind = 'purchased' AND l.deleted_at IS NULL)
+		AND NOT EXISTS (SELECT 1 FROM credit_buckets o WHERE o.ledger_entry_id = e.id)`).Error
+	if err != nil {
+		return err
+	}
+
+	// The bucket holds what the user's other buckets do not already cover
+	return tx.Exec(`
+		INSERT INTO credit_buckets (created_at, updated_at, user_id, kind, granted, remaining, ledger_entry_id)
+		SELECT NOW(), NOW(), e.user_id, 'purchased', e.amount,
+			LEAST(e.amount, GREATEST(c.credit_amount - COALESCE((
+				SELECT SUM(b.remaining) FROM credit_buckets b
+				WHERE b.user_id = e.user_id AND b.remaining > 0 AND b.deleted_at IS NULL), 0), 0)),
+			e.id
+		FROM ledger_entries e
+		JOIN user_credits c ON c.user_id = e.user_id AND c.deleted_at IS NULL
+		WHERE e.entry_type = 'OPENING_BALANCE' AND e.source_type = 'USER_CREDITS'
+		AND e.credit_account = 'user:' || e.user_id
+		AND NOT EXISTS (SELECT 1 FROM credit_buckets o WHERE o.ledger_entry_id = e.id)
+		ON CONFLICT (ledger_entry_id) WHERE ledger_entry_id > 0 DO NOTHING`).Error
 }
 
 func ProcessDatabaseResponse(response *gorm.DB) error {
@@ -41,6 +41,24 @@ func SendSubscriptionEvent(eventType string, recipient string, data model.EmailD
 	case "EXPIRATION":
 		title = "Your subscription has expired!"
 		tmpl = *templates.EmailTemplates.Expiration
+	case "UNCANCELLATION":
+		title = "Your subscription has been reactivated!"
+		tmpl = *templates.EmailTemplates.Uncancellation
+	case "SUBSCRIPTION_PAUSED":
+		title = "Your subscription has been paused"
+		tmpl = *templates.EmailTemplates.Paused
+	case "BILLING_ISSUE":
+		title = "There was a problem with your payment"
+		tmpl = *templates.EmailTemplates.BillingIssue
+	case "PRODUCT_CHANGE":
+		title = "Your subscription plan has changed"
+		tmpl = *templates.EmailTemplates.ProductChange
+	case "SUBSCRIPTION_EXTENDED":
+		title = "Your subscription has been extended!"
+		tmpl = *templates.EmailTemplates.Extension
+	case "TRANSFER":
+		title = "Your subscription has moved to another account"
+		tmpl = *templates.EmailTemplates.Transfer
 	default:
 		return os.ErrInvalid
 	}
@@ -104,3 +122,29 @@ func SendVerificationCode(emailType string, recipient string, data model.Verific
 
 	return err
 }
+
+func SendBalanceNotification(recipient string, data model.BalanceEmailData) error {
+	title := "Your LensQuery credits are running low"
+	if data.Depleted {
+		title = "You are out of LensQuery credits"
+	}
+
+	var emailBody bytes.Buffer
+	err := templates.EmailTemplates.LowBalance.Execute(&emailBody, data)
+	if err != nil {
+		log.Println("[Err]", err)
+		return err
+	}
+
+	subject := "Subject: " + title + "\r\n"
+	from := fmt.Sprintf("From: %s <%s>\r\n", "LensQuery", GoogleEmail)
+	toHeader := "To: " + recipient + "\r\n"
+	mime := "MIME-version: 1.0\r\nContent-Type: text/html; charset=\"UTF-8\";\r\n\r\n"
+
+	headers := subject + from + toHeader + mime
+	msg := []byte(headers + "\r\n" + emailBody.String())
+	to := []string{recipient}
+	err = smtp.SendMail(GoogleSMTPServer+":"+strconv.Itoa(GoogleSMTPPort), auth, GoogleEmail, to, msg)
+
+	return err
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/vndee/lensquery-backend/pkg/config"
 	"github.com/vndee/lensquery-backend/pkg/database"
 	"github.com/vndee/lensquery-backend/pkg/email"
+	"github.com/vndee/lensquery-backend/pkg/ledger"
 	"github.com/vndee/lensquery-backend/pkg/limiter"
 	"github.com/vndee/lensquery-backend/pkg/model"
 )
@@ -270,14 +271,18 @@ func ActivateUserTrial(c *fiber.Ctx) error {
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 
-	// create user credits
-	credits := model.UserCredits{
-		UserID:               params.UserId,
-		PurchasedTimestampMs: trialData.CreatedAt.Unix(),
-		CreditAmount:         config.TrialCreditAmount,
-	}
-
-	err = database.Pool.Create(&credits).Error
+	// grant trial credits, which lapse with the trial
+	trialExpiresAt := time.Now().Add(config.TrialPeriod)
+	_, err = ledger.Post(ledger.Posting{
+		UserID:       params.UserId,
+		EntryType:    ledger.EntryTrial,
+		Amount:       model.NewCredits(config.TrialCreditAmount),
+		Counterparty: ledger.AccountTrial,
+		SourceType:   ledger.SourceTrial,
+		SourceID:     params.UserId,
+		Bucket:       ledger.BucketTrial,
+		ExpiresAt:    &trialExpiresAt,
+	})
 	if err != nil {
 		log.Println("Database:", err)
 		// delete trial data
@@ -285,6 +290,11 @@ func ActivateUserTrial(c *fiber.Ctx) error {
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 
+	err = rewardReferral(params.UserId, ReferralTriggerTrial)
+	if err != nil {
+		log.Println("Reward referral:", err)
+	}
+
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"exp": trialData.ExpiredTimestampMs,
 	})
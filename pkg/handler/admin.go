@@ -0,0 +1,623 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/gofiber/fiber/v2"
+	gofiberfirebaseauth "github.com/sacsand/gofiber-firebaseauth"
+	"github.com/vndee/lensquery-backend/pkg/config"
+	"github.com/vndee/lensquery-backend/pkg/database"
+	"github.com/vndee/lensquery-backend/pkg/ledger"
+	"github.com/vndee/lensquery-backend/pkg/model"
+	"github.com/vndee/lensquery-backend/pkg/queue"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Audit actions
+const (
+	AuditViewUser         = "VIEW_USER"
+	AuditAdjustCredit     = "ADJUST_CREDIT"
+	AuditRevertAdjustment = "REVERT_ADJUSTMENT"
+	AuditCreatePromoCode  = "CREATE_PROMO_CODE"
+	AuditReprocessWebhook = "REPROCESS_WEBHOOK"
+	AuditResolveFlag      = "RESOLVE_FLAG"
+	AuditRequeueWebhook   = "REQUEUE_WEBHOOK"
+)
+
+func recordAudit(tx *gorm.DB, actorUID string, action string, targetUserID string, reason string, details interface{}) error {
+	data, err := sonic.Marshal(details)
+	if err != nil {
+		return err
+	}
+
+	return tx.Create(&model.AuditLog{
+		ActorUID:     actorUID,
+		Action:       action,
+		TargetUserID: targetUserID,
+		Reason:       reason,
+		Details:      string(data),
+	}).Error
+}
+
+func GetAdminUserDetails(c *fiber.Ctx) error {
+	actor := c.Locals("user").(gofiberfirebaseauth.User)
+	userID := c.Params("uid")
+
+	details := model.AdminUserDetails{}
+
+	var credits model.UserCredits
+	response := database.Pool.Where("user_id = ?", userID).Limit(1).Find(&credits)
+	if response.Error != nil {
+		log.Println("Database:", response.Error)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	if response.RowsAffected > 0 {
+		details.Credits = &credits
+	}
+
+	var trial model.UserTrialData
+	response = database.Pool.Where("user_id = ?", userID).Limit(1).Find(&trial)
+	if response.Error != nil {
+		log.Println("Database:", response.Error)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	if response.RowsAffected > 0 {
+		details.Trial = &trial
+	}
+
+	err := database.Pool.Where("user_id = ?", userID).Order("id ASC").Find(&details.Buckets).Error
+	if err != nil {
+		log.Println("Database:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	err = database.Pool.Where("user_id = ?", userID).Order("id DESC").Limit(config.AdminLedgerPageSize).Find(&details.Ledger).Error
+	if err != nil {
+		log.Println("Database:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	err = database.Pool.Where("user_id = ?", userID).Order("id DESC").Find(&details.Adjustments).Error
+	if err != nil {
+		log.Println("Database:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	err = database.Pool.Where("user_id = ?", userID).Order("id DESC").Find(&details.Flags).Error
+	if err != nil {
+		log.Println("Database:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	err = database.Pool.Where("user_id = ?", userID).Order("created_at ASC").Find(&details.Aliases).Error
+	if err != nil {
+		log.Println("Database:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	err = recordAudit(database.Pool, actor.UserID, AuditViewUser, userID, "", fiber.Map{})
+	if err != nil {
+		log.Println("Audit:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(details)
+}
+
+// AdjustUserCredit grants (positive amount) or deducts (negative amount)
+// credits by hand. A reason is mandatory.
+func AdjustUserCredit(c *fiber.Ctx) error {
+	actor := c.Locals("user").(gofiberfirebaseauth.User)
+	userID := c.Params("uid")
+
+	params := model.CreditAdjustmentParams{}
+	if err := c.BodyParser(&params); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	params.Reason = strings.TrimSpace(params.Reason)
+	if params.Amount == 0 || params.Reason == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "amount and reason are required",
+		})
+	}
+
+	adjustment := model.CreditAdjustment{
+		UserID:   userID,
+		Amount:   params.Amount,
+		Reason:   params.Reason,
+		ActorUID: actor.UserID,
+	}
+
+	err := database.Pool.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&adjustment).Error; err != nil {
+			return err
+		}
+
+		entry, err := ledger.PostTx(tx, ledger.Posting{
+			UserID:       userID,
+			EntryType:    ledger.EntryAdjustment,
+			Amount:       params.Amount,
+			Counterparty: ledger.AdminAccount(actor.UserID),
+			SourceType:   ledger.SourceAdjustment,
+			SourceID:     strconv.FormatUint(uint64(adjustment.ID), 10),
+			Memo:         params.Reason,
+			Bucket:       ledger.BucketPromotional,
+		})
+		if err != nil {
+			return err
+		}
+
+		adjustment.LedgerEntryID = entry.ID
+		err = tx.Model(&model.CreditAdjustment{}).Where("id = ?", adjustment.ID).Update("ledger_entry_id", entry.ID).Error
+		if err != nil {
+			return err
+		}
+
+		return recordAudit(tx, actor.UserID, AuditAdjustCredit, userID, params.Reason, fiber.Map{
+			"adjustment_id":   adjustment.ID,
+			"amount":          params.Amount,
+			"ledger_entry_id": entry.ID,
+		})
+	})
+
+	if errors.Is(err, ledger.ErrInsufficientCredit) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Deduction exceeds the user's balance",
+		})
+	}
+	if err != nil {
+		log.Println("Adjust credit:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(adjustment)
+}
+
+// RevertCreditAdjustment posts the opposite of an earlier adjustment.
+func RevertCreditAdjustment(c *fiber.Ctx) error {
+	actor := c.Locals("user").(gofiberfirebaseauth.User)
+
+	adjustmentID, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	params := model.RevertCreditAdjustmentParams{}
+	if err := c.BodyParser(&params); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	params.Reason = strings.TrimSpace(params.Reason)
+	if params.Reason == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "reason is required",
+		})
+	}
+
+	var adjustment model.CreditAdjustment
+	err = database.Pool.Transaction(func(tx *gorm.DB) error {
+		response := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&adjustment, adjustmentID)
+		if err := database.ProcessDatabaseResponse(response); err != nil {
+			return err
+		}
+		if adjustment.RevertedAt != nil {
+			return ledger.ErrDuplicateEntry
+		}
+
+		// Take a granted amount back out of the bucket it created
+		var bucket model.CreditBucket
+		err := tx.Where("ledger_entry_id = ?", adjustment.LedgerEntryID).Limit(1).Find(&bucket).Error
+		if err != nil {
+			return err
+		}
+
+		var bucketID uint
+		if bucket.Model != nil {
+			bucketID = bucket.ID
+		}
+
+		entry, err := ledger.PostTx(tx, ledger.Posting{
+			UserID:         adjustment.UserID,
+			EntryType:      ledger.EntryAdjustmentRevert,
+			Amount:         -adjustment.Amount,
+			Counterparty:   ledger.AdminAccount(actor.UserID),
+			SourceType:     ledger.SourceAdjustment,
+			SourceID:       strconv.FormatUint(uint64(adjustment.ID), 10),
+			Memo:           params.Reason,
+			AllowOverdraft: true,
+			Bucket:         ledger.BucketPromotional,
+			FromBucket:     bucketID,
+		})
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		adjustment.RevertedBy = actor.UserID
+		adjustment.RevertedAt = &now
+		err = tx.Model(&model.CreditAdjustment{}).Where("id = ?", adjustment.ID).Updates(map[string]interface{}{
+			"reverted_by": actor.UserID,
+			"reverted_at": &now,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		return recordAudit(tx, actor.UserID, AuditRevertAdjustment, adjustment.UserID, params.Reason, fiber.Map{
+			"adjustment_id":   adjustment.ID,
+			"amount":          -adjustment.Amount,
+			"ledger_entry_id": entry.ID,
+		})
+	})
+
+	if errors.Is(err, fiber.ErrNotFound) {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if errors.Is(err, ledger.ErrDuplicateEntry) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Adjustment has already been reverted",
+		})
+	}
+	if err != nil {
+		log.Println("Revert adjustment:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(adjustment)
+}
+
+func ListAuditLogs(c *fiber.Ctx) error {
+	query := database.Pool.Order("id DESC").Limit(config.AdminLedgerPageSize)
+	if userID := c.Query("user_id"); userID != "" {
+		query = query.Where("target_user_id = ?", userID)
+	}
+	if actorUID := c.Query("actor_uid"); actorUID != "" {
+		query = query.Where("actor_uid = ?", actorUID)
+	}
+	if cursor := c.QueryInt("cursor"); cursor > 0 {
+		query = query.Where("id < ?", cursor)
+	}
+
+	logs := []model.AuditLog{}
+	err := query.Find(&logs).Error
+	if err != nil {
+		log.Println("Database:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(logs)
+}
+
+func ListReconciliationReports(c *fiber.Ctx) error {
+	query := database.Pool.Preload("Discrepancies").Order("id DESC").Limit(config.ReconcileReportSize)
+	if cursor := c.QueryInt("cursor"); cursor > 0 {
+		query = query.Where("id < ?", cursor)
+	}
+
+	reports := []model.ReconciliationReport{}
+	err := query.Find(&reports).Error
+	if err != nil {
+		log.Println("Database:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(reports)
+}
+
+func ListWebhookEvents(c *fiber.Ctx) error {
+	query := database.Pool.Order("created_at DESC").Limit(config.AdminLedgerPageSize)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if eventType := c.Query("type"); eventType != "" {
+		query = query.Where("type = ?", eventType)
+	}
+	if userID := c.Query("user_id"); userID != "" {
+		query = query.Where("app_user_id = ?", userID)
+	}
+	if environment := c.Query("environment"); environment != "" {
+		query = query.Where("environment = ?", environment)
+	}
+	if before := c.Query("before"); before != "" {
+		cursor, err := time.Parse(time.RFC3339Nano, before)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid before",
+			})
+		}
+		query = query.Where("created_at < ?", cursor)
+	}
+
+	events := []model.WebhookEvent{}
+	err := query.Find(&events).Error
+	if err != nil {
+		log.Println("Database:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(events)
+}
+
+// ReprocessWebhookEvent applies a webhook event that failed, got stuck or was
+// ignored again from its stored payload. Processed events are never reapplied.
+func ReprocessWebhookEvent(c *fiber.Ctx) error {
+	actor := c.Locals("user").(gofiberfirebaseauth.User)
+
+	params := model.ReprocessWebhookEventParams{}
+	if err := c.BodyParser(&params); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	var record model.WebhookEvent
+	response := database.Pool.Where("id = ?", c.Params("id")).First(&record)
+	if err := database.ProcessDatabaseResponse(response); err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	payload := model.WebhookPayload{}
+	if err := sonic.Unmarshal([]byte(record.Payload), &payload); err != nil {
+		log.Println("Unmarshal webhook payload:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	claimed, err := claimWebhookEvent(record.ID, WebhookEventReceived, WebhookEventProcessing, WebhookEventFailed, WebhookEventIgnored)
+	if err != nil {
+		log.Println("Database:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	if !claimed {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Event has already been processed",
+		})
+	}
+
+	err = recordAudit(database.Pool, actor.UserID, AuditReprocessWebhook, record.AppUserID, params.Reason, fiber.Map{
+		"event_id":   record.ID,
+		"event_type": record.Type,
+		"status":     record.Status,
+	})
+	if err != nil {
+		log.Println("Database:", err)
+	}
+
+	_, err = processWebhookEvent(&payload.Event)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	response = database.Pool.Where("id = ?", record.ID).First(&record)
+	if err := database.ProcessDatabaseResponse(response); err != nil {
+		log.Println("Database:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(record)
+}
+
+func GetWebhookQueueStats(c *fiber.Ctx) error {
+	stats, err := queue.Webhooks.Stats(c.Context())
+	if err != nil {
+		log.Println("Redis:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(stats)
+}
+
+// ListDeadLetteredWebhookEvents lists the events the queue gave up on, most
+// recently dead-lettered first, with their last error.
+func ListDeadLetteredWebhookEvents(c *fiber.Ctx) error {
+	ids, err := queue.Webhooks.DeadLetters(c.Context(), config.AdminLedgerPageSize)
+	if err != nil {
+		log.Println("Redis:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	var records []model.WebhookEvent
+	err = database.Pool.Where("id IN ?", ids).Find(&records).Error
+	if err != nil {
+		log.Println("Database:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	byID := map[string]model.WebhookEvent{}
+	for _, record := range records {
+		byID[record.ID] = record
+	}
+
+	events := []model.WebhookEvent{}
+	for _, id := range ids {
+		if record, ok := byID[id]; ok {
+			events = append(events, record)
+		}
+	}
+
+	return c.Status(fiber.StatusOK).JSON(events)
+}
+
+// RequeueWebhookEvent gives a dead-lettered event a fresh set of attempts.
+func RequeueWebhookEvent(c *fiber.Ctx) error {
+	actor := c.Locals("user").(gofiberfirebaseauth.User)
+
+	params := model.RequeueWebhookEventParams{}
+	if err := c.BodyParser(&params); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	var record model.WebhookEvent
+	response := database.Pool.Where("id = ?", c.Params("id")).First(&record)
+	if err := database.ProcessDatabaseResponse(response); err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	requeued, err := queue.Webhooks.Requeue(c.Context(), record.ID)
+	if err != nil {
+		log.Println("Redis:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	if !requeued {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Event is not dead-lettered",
+		})
+	}
+
+	err = recordAudit(database.Pool, actor.UserID, AuditRequeueWebhook, record.AppUserID, params.Reason, fiber.Map{
+		"event_id":   record.ID,
+		"event_type": record.Type,
+		"error":      record.Error,
+	})
+	if err != nil {
+		log.Println("Database:", err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(record)
+}
+
+// GetRevenueReport sums processed production store events between from and to
+// (RFC 3339, defaulting to the last 30 days). Sandbox events are excluded, and
+// a transaction delivered by several sources is counted once.
+func GetRevenueReport(c *fiber.Ctx) error {
+	report := model.RevenueReport{To: time.Now().UTC()}
+	report.From = report.To.AddDate(0, 0, -30)
+
+	for _, bound := range []struct {
+		name  string
+		value *time.Time
+	}{{"from", &report.From}, {"to", &report.To}} {
+		if raw := c.Query(bound.name); raw != "" {
+			parsed, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Invalid " + bound.name,
+				})
+			}
+			*bound.value = parsed
+		}
+	}
+
+	// Apple and RevenueCat both report App Store transactions, keep the first
+	// purchase and refund of each
+	transactions := database.Pool.Model(&model.WebhookEvent{}).
+		Select("DISTINCT ON (COALESCE(NULLIF(transaction_id, ''), id), price > 0) store, price").
+		Where("environment = ? AND status = ? AND price <> 0", config.EnvironmentProduction, WebhookEventProcessed).
+		Where("created_at >= ? AND created_at < ?", report.From, report.To).
+		Order("COALESCE(NULLIF(transaction_id, ''), id), price > 0, created_at")
+
+	report.Stores = []model.RevenueLine{}
+	err := database.Pool.Table("(?) AS t", transactions).
+		Select(`store,
+			COUNT(*) FILTER (WHERE price > 0) AS purchases,
+			COUNT(*) FILTER (WHERE price < 0) AS refunds,
+			COALESCE(SUM(price) FILTER (WHERE price > 0), 0) AS gross,
+			COALESCE(-SUM(price) FILTER (WHERE price < 0), 0) AS refunded,
+			COALESCE(SUM(price), 0) AS net`).
+		Group("store").Order("store").
+		Scan(&report.Stores).Error
+	if err != nil {
+		log.Println("Database:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	for _, line := range report.Stores {
+		report.Net += line.Net
+	}
+
+	return c.Status(fiber.StatusOK).JSON(report)
+}
+
+// ListAccountFlags lists unresolved flags, or all of them with ?all=true.
+func ListAccountFlags(c *fiber.Ctx) error {
+	query := database.Pool.Order("id DESC").Limit(config.AdminLedgerPageSize)
+	if !c.QueryBool("all") {
+		query = query.Where("resolved_at IS NULL")
+	}
+	if reason := c.Query("reason"); reason != "" {
+		query = query.Where("reason = ?", reason)
+	}
+	if cursor := c.QueryInt("cursor"); cursor > 0 {
+		query = query.Where("id < ?", cursor)
+	}
+
+	flags := []model.AccountFlag{}
+	err := query.Find(&flags).Error
+	if err != nil {
+		log.Println("Database:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(flags)
+}
+
+func ResolveAccountFlag(c *fiber.Ctx) error {
+	actor := c.Locals("user").(gofiberfirebaseauth.User)
+
+	flagID, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	params := model.ResolveAccountFlagParams{}
+	if err := c.BodyParser(&params); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	params.Resolution = strings.TrimSpace(params.Resolution)
+	if params.Resolution == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "resolution is required",
+		})
+	}
+
+	var flag model.AccountFlag
+	err = database.Pool.Transaction(func(tx *gorm.DB) error {
+		response := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&flag, flagID)
+		if err := database.ProcessDatabaseResponse(response); err != nil {
+			return err
+		}
+		if flag.ResolvedAt != nil {
+			return ledger.ErrDuplicateEntry
+		}
+
+		now := time.Now()
+		flag.ResolvedBy = actor.UserID
+		flag.ResolvedAt = &now
+		flag.Resolution = params.Resolution
+		err := tx.Model(&model.AccountFlag{}).Where("id = ?", flag.ID).Updates(map[string]interface{}{
+			"resolved_by": actor.UserID,
+			"resolved_at": &now,
+			"resolution":  params.Resolution,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		return recordAudit(tx, actor.UserID, AuditResolveFlag, flag.UserID, params.Resolution, fiber.Map{
+			"flag_id": flag.ID,
+			"reason":  flag.Reason,
+		})
+	})
+
+	if errors.Is(err, fiber.ErrNotFound) {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if errors.Is(err, ledger.ErrDuplicateEntry) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Flag has already been resolved",
+		})
+	}
+	if err != nil {
+		log.Println("Resolve flag:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(flag)
+}
@@ -0,0 +1,211 @@
+package handler
+
+import (
+	"log"
+	"strings"
+
+	"github.com/bytedance/sonic"
+	"github.com/vndee/lensquery-backend/pkg/config"
+	"github.com/vndee/lensquery-backend/pkg/database"
+	"github.com/vndee/lensquery-backend/pkg/ledger"
+	"github.com/vndee/lensquery-backend/pkg/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// anonymousIDPrefix marks the app user IDs RevenueCat generates before the
+// user signs in.
+const anonymousIDPrefix = "$RCAnonymousID:"
+
+const FlagAliasConflict = "ALIAS_CONFLICT"
+
+// eventUserIDs lists every app user ID the event knows the user by.
+func eventUserIDs(event *model.Event) []string {
+	ids := []string{}
+	seen := map[string]bool{}
+	for _, id := range append([]string{event.AppUserID, event.OriginalAppUserID}, event.Aliases...) {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// canonicalUserID picks the Firebase UID owning ids: the one any of them is
+// already linked to, or else the first that is not anonymous. It is empty
+// when all of them are anonymous.
+func canonicalUserID(tx *gorm.DB, ids []string) (string, error) {
+	var alias model.AccountAlias
+	response := tx.Where("alias IN ?", ids).Order("created_at ASC").Limit(1).Find(&alias)
+	if response.Error != nil {
+		return "", response.Error
+	}
+	if response.RowsAffected > 0 {
+		return alias.UserID, nil
+	}
+
+	for _, id := range ids {
+		if !strings.HasPrefix(id, anonymousIDPrefix) {
+			return id, nil
+		}
+	}
+
+	return "", nil
+}
+
+// resolveUserID returns the Firebase UID userID is linked to, or userID
+// itself when it is not an alias.
+func resolveUserID(tx *gorm.DB, userID string) (string, error) {
+	var alias model.AccountAlias
+	response := tx.Where("alias = ?", userID).Limit(1).Find(&alias)
+	if response.Error != nil || response.RowsAffected == 0 {
+		return userID, response.Error
+	}
+
+	return alias.UserID, nil
+}
+
+// resolveEventUser links the anonymous IDs of the event to the canonical
+// user, merges the credits and history of those seen for the first time into
+// it, and points the event at the canonical user. Two real accounts are never
+// merged, the conflict is flagged for review instead.
+func resolveEventUser(event *model.Event) error {
+	ids := eventUserIDs(event)
+	if len(ids) == 0 {
+		return nil
+	}
+
+	var canonical string
+	err := database.Pool.Transaction(func(tx *gorm.DB) error {
+		var err error
+		canonical, err = canonicalUserID(tx, ids)
+		if err != nil || canonical == "" {
+			return err
+		}
+
+		for _, id := range ids {
+			if id == canonical {
+				continue
+			}
+
+			if !strings.HasPrefix(id, anonymousIDPrefix) {
+				if err := flagAliasConflict(tx, canonical, id); err != nil {
+					return err
+				}
+				continue
+			}
+
+			response := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&model.AccountAlias{Alias: id, UserID: canonical})
+			if response.Error != nil {
+				return response.Error
+			}
+
+			// Already linked, possibly to another account
+			if response.RowsAffected == 0 {
+				owner, err := resolveUserID(tx, id)
+				if err != nil {
+					return err
+				}
+				if owner != canonical {
+					if err := flagAliasConflict(tx, canonical, owner); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+
+			if err := mergeAccountTx(tx, id, canonical); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if canonical != "" {
+		event.AppUserID = canonical
+	}
+
+	return nil
+}
+
+// isSandboxTesterEvent reports whether any ID of the event, or the account it
+// is linked to, is an allowlisted sandbox tester. It links nothing.
+func isSandboxTesterEvent(event *model.Event) (bool, error) {
+	for _, id := range eventUserIDs(event) {
+		userID, err := resolveUserID(database.Pool, id)
+		if err != nil {
+			return false, err
+		}
+		if config.IsSandboxTester(id) || config.IsSandboxTester(userID) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// flagAliasConflict flags userID for review when an event links it to the
+// other real account otherUserID, unless that conflict is already flagged.
+func flagAliasConflict(tx *gorm.DB, userID string, otherUserID string) error {
+	log.Printf("Account %s is linked to another account %s, flagging", userID, otherUserID)
+
+	details, err := sonic.Marshal(map[string]interface{}{
+		"other_user_id": otherUserID,
+	})
+	if err != nil {
+		return err
+	}
+
+	var open int64
+	err = tx.Model(&model.AccountFlag{}).
+		Where("user_id = ? AND reason = ? AND details = ? AND resolved_at IS NULL", userID, FlagAliasConflict, string(details)).
+		Count(&open).Error
+	if err != nil || open > 0 {
+		return err
+	}
+
+	return tx.Create(&model.AccountFlag{
+		UserID:  userID,
+		Reason:  FlagAliasConflict,
+		Details: string(details),
+	}).Error
+}
+
+// mergeAccountTx moves the credits, holds, usage history, trial and
+// subscription of alias over to userID. Records userID already has are kept.
+func mergeAccountTx(tx *gorm.DB, alias string, userID string) error {
+	moved, err := ledger.MergeTx(tx, alias, userID)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Model(&model.CreditUsageHistory{}).Where("user_id = ?", alias).Update("user_id", userID).Error
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []interface{}{&model.UserTrialData{}, &model.Subscription{}} {
+		var owned int64
+		err := tx.Model(table).Where("user_id = ?", userID).Count(&owned).Error
+		if err != nil {
+			return err
+		}
+		if owned > 0 {
+			continue
+		}
+
+		err = tx.Model(table).Where("user_id = ?", alias).Update("user_id", userID).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Merged account %s into %s, moved %s credits", alias, userID, moved)
+	return nil
+}
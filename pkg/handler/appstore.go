@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"errors"
+	"log"
+
+	"github.com/bytedance/sonic"
+	"github.com/gofiber/fiber/v2"
+	"github.com/vndee/lensquery-backend/pkg/appstore"
+	"github.com/vndee/lensquery-backend/pkg/config"
+	"github.com/vndee/lensquery-backend/pkg/database"
+	"github.com/vndee/lensquery-backend/pkg/model"
+)
+
+var errUnknownAppStoreUser = errors.New("no user for App Store transaction")
+
+// AppStoreNotification accepts App Store Server Notifications v2 sent by
+// Apple directly, and queues them as the RevenueCat events they amount to.
+func AppStoreNotification(c *fiber.Ctx) error {
+	if config.AppleRootCAs == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "App Store notifications are not configured",
+		})
+	}
+
+	body := appstore.ResponseBodyV2{}
+	if err := c.BodyParser(&body); err != nil || body.SignedPayload == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Missing signedPayload",
+		})
+	}
+
+	verifier := appstore.Verifier{Roots: config.AppleRootCAs, BundleID: config.AppleBundleID}
+	notification, err := verifier.ParseNotification(body.SignedPayload)
+	if err != nil {
+		log.Printf("App Store notification rejected from %s: %v", c.IP(), err)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unauthorized",
+		})
+	}
+
+	event, ok := appstore.ToEvent(notification)
+	if !ok {
+		log.Printf("App Store notification %s %s/%s ignored", notification.Payload.NotificationUUID, notification.Payload.NotificationType, notification.Payload.Subtype)
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"ignored": true,
+		})
+	}
+	if event.ID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Missing notification id",
+		})
+	}
+
+	var unresolved error
+	if event.Type != "TEST" {
+		event.AppUserID, err = appStoreUserID(notification.Transaction)
+		if errors.Is(err, errUnknownAppStoreUser) {
+			log.Printf("App Store notification %s: %v %s", event.ID, err, event.OriginalTransactionID)
+			unresolved = err
+		} else if err != nil {
+			log.Println("Database:", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+	}
+
+	// Stored as a RevenueCat delivery, so the queue and replays handle it alike
+	payload, err := sonic.Marshal(model.WebhookPayload{APIVersion: "1.0", Event: event})
+	if err != nil {
+		log.Println("Marshal:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	// Without even an appAccountToken to wait on, queueing would only end in
+	// the dead-letter list; park the event for a replay once the user is known
+	if event.AppUserID == "" && unresolved != nil {
+		if _, err := recordIgnoredWebhookEvent(&event, payload, unresolved.Error()); err != nil {
+			log.Println("Database:", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"ignored": true,
+		})
+	}
+
+	return acceptWebhookEvent(c, &event, payload)
+}
+
+// appStoreUserID finds the user behind a transaction: the account the app's
+// appAccountToken is linked to, or else the user earlier events of the same
+// original transaction were for. Unknown users fall back to the token, which
+// resolves once it is linked as an alias.
+func appStoreUserID(transaction *appstore.TransactionInfo) (string, error) {
+	if transaction.AppAccountToken != "" {
+		userID, err := resolveUserID(database.Pool, transaction.AppAccountToken)
+		if err != nil || userID != transaction.AppAccountToken {
+			return userID, err
+		}
+	}
+
+	var userIDs []string
+	err := database.Pool.Model(&model.WebhookEvent{}).
+		Where("app_user_id <> '' AND payload::jsonb->'event'->>'original_transaction_id' = ?", transaction.OriginalTransactionID).
+		Order("created_at ASC").Limit(1).
+		Pluck("app_user_id", &userIDs).Error
+	if err != nil {
+		return "", err
+	}
+	if len(userIDs) > 0 {
+		return resolveUserID(database.Pool, userIDs[0])
+	}
+
+	return transaction.AppAccountToken, errUnknownAppStoreUser
+}
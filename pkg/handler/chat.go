@@ -2,6 +2,7 @@ package handler
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -9,6 +10,9 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/bytedance/sonic"
 	"github.com/gofiber/fiber/v2"
@@ -17,10 +21,19 @@ import (
 	"github.com/valyala/fasthttp"
 	"github.com/vndee/lensquery-backend/pkg/config"
 	"github.com/vndee/lensquery-backend/pkg/database"
+	"github.com/vndee/lensquery-backend/pkg/ledger"
+	"github.com/vndee/lensquery-backend/pkg/middleware"
 	"github.com/vndee/lensquery-backend/pkg/model"
+	"github.com/vndee/lensquery-backend/pkg/notify"
 	"gorm.io/gorm"
 )
 
+var ErrModelDisabled = errors.New("model is disabled")
+
+// ErrPricingUnavailable is returned when OpenRouter cannot be asked for the
+// model prices a chat is reserved against.
+var ErrPricingUnavailable = errors.New("model pricing is unavailable")
+
 func ListAvailabelModels(c *fiber.Ctx) error {
 	client := &http.Client{}
 	req, err := http.NewRequest("GET", config.OpenRouterEndpoint+"/models", nil)
@@ -45,11 +58,40 @@ func ListAvailabelModels(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).SendString(INTERNAL_SERVER_ERROR)
 	}
 
+	// Hide disabled models and show what the user will actually pay
+	models, _ := responseData["data"].([]interface{})
+	availableModels := make([]interface{}, 0, len(models))
+	for _, item := range models {
+		modelData, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		modelID, _ := modelData["id"].(string)
+		price := config.GetModelPrice(modelID)
+		if price.Disabled {
+			continue
+		}
+
+		if pricing, ok := modelData["pricing"].(map[string]interface{}); ok {
+			promptPrice, _ := strconv.ParseFloat(fmt.Sprint(pricing["prompt"]), 64)
+			completionPrice, _ := strconv.ParseFloat(fmt.Sprint(pricing["completion"]), 64)
+			promptPrice, completionPrice = price.TokenPrices(promptPrice, completionPrice)
+
+			pricing["prompt"] = strconv.FormatFloat(promptPrice, 'f', -1, 64)
+			pricing["completion"] = strconv.FormatFloat(completionPrice, 'f', -1, 64)
+			pricing["min_charge"] = strconv.FormatFloat(price.MinCharge, 'f', -1, 64)
+		}
+
+		availableModels = append(availableModels, modelData)
+	}
+	responseData["data"] = availableModels
+
 	return c.Status(fiber.StatusOK).JSON(responseData)
 }
 
 func Completion(c *fiber.Ctx) error {
-	if !checkAvailableCredit(c) {
+	if err := checkAvailableCredit(c); err != nil {
 		return c.Status(fiber.StatusPaymentRequired).JSON(fiber.Map{
 			"error": "Insufficient credit",
 		})
@@ -65,6 +107,49 @@ func Completion(c *fiber.Ctx) error {
 		})
 	}
 
+	// Reserve the most this completion can cost before opening the stream
+	maxCost, err := estimateMaxChatCost(requestBody)
+	if errors.Is(err, ErrModelDisabled) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if errors.Is(err, ErrPricingUnavailable) {
+		log.Println("Estimate chat cost:", err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": ErrPricingUnavailable.Error(),
+		})
+	}
+	if err != nil {
+		log.Println("Estimate chat cost:", err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	caps, err := spendingCaps(user.UserID)
+	if err != nil {
+		log.Println("Database:", err)
+		return c.Status(fiber.StatusInternalServerError).SendString(INTERNAL_SERVER_ERROR)
+	}
+
+	hold, err := ledger.Reserve(user.UserID, maxCost, config.ChatHoldTTL, caps...)
+	if handled, err := sendSpendingCapExceeded(c, err); handled {
+		return err
+	}
+	if errors.Is(err, ledger.ErrInsufficientCredit) {
+		return c.Status(fiber.StatusPaymentRequired).JSON(fiber.Map{
+			"error":    "Insufficient credit",
+			"required": maxCost,
+		})
+	}
+	if err != nil {
+		log.Println("Reserve credit:", err)
+		return c.Status(fiber.StatusInternalServerError).SendString(INTERNAL_SERVER_ERROR)
+	}
+
+	idempotencyKey, _ := c.Locals(middleware.IdempotencyKeyLocal).(string)
+
 	c.Set(fiber.HeaderContentType, "text/event-stream")
 	c.Set(fiber.HeaderCacheControl, "no-cache")
 	c.Set(fiber.HeaderConnection, "keep-alive")
@@ -75,33 +160,72 @@ func Completion(c *fiber.Ctx) error {
 		stream, err := config.OpenRouterClient.CreateChatCompletionStream(context.Background(), *requestBody)
 		if err != nil {
 			log.Println("CreateChatCompletionStream:", err)
+			releaseChatHold(hold, "stream failed")
+			if idempotencyKey != "" {
+				middleware.ReleaseIdempotencyKey(idempotencyKey)
+			}
 			return
 		}
 		defer stream.Close()
 
 		var requestID string
 
+		// Keep a copy of the events for replays of the same Idempotency-Key
+		var transcript bytes.Buffer
+		out := io.MultiWriter(w, &transcript)
+
+		// A billed request replays what was streamed, however much that was,
+		// so a retry cannot charge twice; one that was not billed may retry
+		finishIdempotentRequest := func(charged bool) {
+			if idempotencyKey == "" {
+				return
+			}
+			if charged {
+				middleware.SaveIdempotentResponse(idempotencyKey, fiber.StatusOK, "text/event-stream", transcript.Bytes())
+			} else {
+				middleware.ReleaseIdempotencyKey(idempotencyKey)
+			}
+		}
+
 		for {
 			response, err := stream.Recv()
 
 			if errors.Is(err, io.EOF) {
-				fmt.Fprintf(w, "data: [DONE]\n\n")
+				fmt.Fprintf(out, "data: [DONE]\n\n")
 				err = w.Flush()
 				if err != nil {
 					fmt.Printf("Error while flushing: %v. Closing http connection.\n", err)
 				}
 				log.Println("Checkpoint 1", requestID)
-				err := decreaseUserCredit(user.UserID, requestID)
+				err := decreaseUserCredit(hold, user.UserID, requestBody.Model, requestID)
 				if err != nil {
 					fmt.Printf("Error while decreasing user credit: %v. Closing http connection.\n", err)
 				}
+				finishIdempotentRequest(err == nil)
+
+				stream.Close()
+				break
+			}
+
+			if err != nil {
+				log.Println("Stream receive:", err)
+				if requestID == "" {
+					releaseChatHold(hold, "stream failed")
+					finishIdempotentRequest(false)
+				} else {
+					err := decreaseUserCredit(hold, user.UserID, requestBody.Model, requestID)
+					if err != nil {
+						fmt.Printf("Error while decreasing user credit: %v. Closing http connection.\n", err)
+					}
+					finishIdempotentRequest(err == nil)
+				}
 
 				stream.Close()
 				break
 			}
 
 			requestID = response.ID
-			fmt.Fprintf(w, "data: %s\n\n", response.Choices[0].Delta.Content)
+			fmt.Fprintf(out, "data: %s\n\n", response.Choices[0].Delta.Content)
 
 			err = w.Flush()
 			if err != nil {
@@ -110,10 +234,12 @@ func Completion(c *fiber.Ctx) error {
 				// dead connections must be closed here.
 				fmt.Printf("Error while flushing: %v. Closing http connection.\n", err)
 
-				err := decreaseUserCredit(user.UserID, requestID)
+				err := decreaseUserCredit(hold, user.UserID, requestBody.Model, requestID)
 				if err != nil {
 					fmt.Printf("Error while decreasing user credit: %v. Closing http connection.\n", err)
 				}
+				finishIdempotentRequest(err == nil)
+
 				stream.Close()
 				break
 			}
@@ -123,76 +249,226 @@ func Completion(c *fiber.Ctx) error {
 	return nil
 }
 
-func checkAvailableCredit(c *fiber.Ctx) bool {
+// checkAvailableCredit makes sure the user can pay at least the minimum chat
+// charge. Spending caps are enforced against the full estimate by Reserve.
+func checkAvailableCredit(c *fiber.Ctx) error {
 	user := c.Locals("user").(gofiberfirebaseauth.User)
-	var response *gorm.DB
-	var userCredits model.UserCredits
-	response = database.Pool.Where("user_id = ?", user.UserID).First(&userCredits)
-	if err := database.ProcessDatabaseResponse(response); err != nil {
-		return false
+	available, err := ledger.Available(user.UserID)
+	if err != nil {
+		return err
 	}
 
-	if userCredits.CreditAmount <= config.MinPrice {
-		return false
+	minCharge := model.NewCredits(config.DefaultModelPrice().MinCharge)
+	if available <= minCharge {
+		return ledger.ErrInsufficientCredit
 	}
 
-	return true
+	return nil
 }
 
-func decreaseUserCredit(userID string, requestID string) error {
-	url := fmt.Sprintf("%s/generation?id=%s", config.OpenRouterEndpoint, requestID)
-	req, err := http.NewRequest("GET", url, nil)
+// estimateMaxChatCost prices the prompt and the full completion budget of the
+// request. When the client sets no max_tokens a default budget is applied to
+// the request so the stream cannot outgrow the reservation.
+func estimateMaxChatCost(request *openai.ChatCompletionRequest) (model.Credits, error) {
+	price := config.GetModelPrice(request.Model)
+	if price.Disabled {
+		return 0, ErrModelDisabled
+	}
+
+	modelInfo, err := getModelPricing(request.Model)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", config.OpenRouterAPIKey))
-	req.Header.Set("HTTP-Referer", "https://lensquery.com/")
-	req.Header.Set("X-Title", "LensQuery")
-	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	promptPrice, err := strconv.ParseFloat(modelInfo.Pricing.Prompt, 64)
 	if err != nil {
-		return err
+		return 0, fmt.Errorf("invalid prompt price for model %s", request.Model)
+	}
+
+	completionPrice, err := strconv.ParseFloat(modelInfo.Pricing.Completion, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid completion price for model %s", request.Model)
+	}
+
+	var promptChars int
+	for _, message := range request.Messages {
+		promptChars += len(message.Role) + len(message.Content) + len(message.Name)
+	}
+	promptTokens := promptChars/config.EstimatedCharsPerToken + 4*len(request.Messages)
+
+	if request.MaxTokens <= 0 {
+		request.MaxTokens = config.DefaultChatMaxTokens
+		if limit := modelInfo.TopProvider.MaxCompletionTokens; limit > 0 && limit < request.MaxTokens {
+			request.MaxTokens = limit
+		}
+	}
+
+	promptPrice, completionPrice = price.TokenPrices(promptPrice, completionPrice)
+	cost := float64(promptTokens)*promptPrice + float64(request.MaxTokens)*completionPrice
+	if cost < price.MinCharge {
+		cost = price.MinCharge
+	}
+
+	return model.NewCredits(cost), nil
+}
+
+var (
+	modelPricingClient    = &http.Client{Timeout: config.ModelPricingTimeout}
+	modelPricingMutex     sync.RWMutex
+	modelPricingCache     map[string]model.OpenRouterModel
+	modelPricingFetchedAt time.Time
+)
+
+func getModelPricing(modelID string) (*model.OpenRouterModel, error) {
+	modelPricingMutex.RLock()
+	modelInfo, ok := modelPricingCache[modelID]
+	fresh := time.Since(modelPricingFetchedAt) < config.ModelPricingCacheTTL
+	modelPricingMutex.RUnlock()
+
+	if ok && fresh {
+		return &modelInfo, nil
+	}
+
+	resp, err := modelPricingClient.Get(config.OpenRouterEndpoint + "/models")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrPricingUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: status %d", ErrPricingUnavailable, resp.StatusCode)
 	}
 
 	responseBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("%w: %v", ErrPricingUnavailable, err)
 	}
 
-	chatHistory, err := parseChatHistory(responseBody)
+	var models model.OpenRouterModelsResponse
+	err = sonic.Unmarshal(responseBody, &models)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("%w: %v", ErrPricingUnavailable, err)
 	}
 
-	if chatHistory.Usage <= 0 {
-		chatHistory.Usage = config.MinPrice
-	} else {
-		chatHistory.Usage = chatHistory.Usage * config.PriceAdjustFactor
+	cache := make(map[string]model.OpenRouterModel, len(models.Data))
+	for _, m := range models.Data {
+		cache[m.ID] = m
 	}
 
-	var response *gorm.DB
-	var userCredits model.UserCredits
-	response = database.Pool.Where("user_id = ?", userID).First(&userCredits)
-	if err := database.ProcessDatabaseResponse(response); err != nil {
-		return err
+	modelPricingMutex.Lock()
+	modelPricingCache = cache
+	modelPricingFetchedAt = time.Now()
+	modelPricingMutex.Unlock()
+
+	modelInfo, ok = cache[modelID]
+	if !ok {
+		return nil, fmt.Errorf("unknown model %s", modelID)
+	}
+
+	return &modelInfo, nil
+}
+
+func releaseChatHold(hold *model.CreditHold, reason string) {
+	if err := ledger.Release(hold.ID, reason); err != nil {
+		log.Println("Release credit hold:", err)
+	}
+}
+
+func decreaseUserCredit(hold *model.CreditHold, userID string, modelID string, requestID string) error {
+	// Without a generation ID there are no stats to fetch, so the charge is
+	// keyed on the hold and the reservation is billed as is
+	sourceID := requestID
+	if sourceID == "" {
+		sourceID = "hold:" + strconv.FormatUint(uint64(hold.ID), 10)
 	}
 
-	response = database.Pool.Model(&model.UserCredits{}).Where("user_id = ?", userID).Updates(map[string]interface{}{
-		"credit_amount": userCredits.CreditAmount - chatHistory.Usage,
+	chatHistory, err := fetchChatReceipt(modelID, requestID)
+	if err != nil {
+		// The chat was served, so bill the reservation and leave the receipt
+		// unfinalized for the nightly reconciliation to correct
+		log.Printf("Fetch generation %s, charging the reserved %s: %v", requestID, hold.Amount, err)
+		chatHistory = &model.Receipt{
+			ID:        requestID,
+			ModelType: modelID,
+			Usage:     hold.Amount,
+		}
+	}
+
+	var entry *model.LedgerEntry
+	err = database.Pool.Transaction(func(tx *gorm.DB) error {
+		var err error
+		entry, err = ledger.SettleTx(tx, hold.ID, ledger.Posting{
+			UserID:       userID,
+			EntryType:    ledger.EntryChat,
+			Amount:       -chatHistory.Usage,
+			Counterparty: ledger.AccountRevenue,
+			SourceType:   ledger.SourceGeneration,
+			SourceID:     sourceID,
+			Memo:         chatHistory.ModelType,
+		})
+		if err != nil {
+			return err
+		}
+
+		response := tx.Create(&model.CreditUsageHistory{
+			UserID:       userID,
+			Amount:       chatHistory.Usage,
+			Timestamp:    time.Now(),
+			RequestType:  "chat",
+			GenerationID: chatHistory.ID,
+		})
+		if err := database.ProcessDatabaseResponse(response); err != nil {
+			return err
+		}
+
+		if chatHistory.ID == "" {
+			return nil
+		}
+
+		if tx.Where("id = ?", chatHistory.ID).First(&model.Receipt{}).RowsAffected == 0 {
+			response = tx.Create(&chatHistory)
+		} else {
+			response = tx.Model(&model.Receipt{}).Where("id = ?", chatHistory.ID).Updates(chatHistory)
+		}
+
+		return database.ProcessDatabaseResponse(response)
 	})
-	if err := database.ProcessDatabaseResponse(response); err != nil {
+	if err != nil {
 		return err
 	}
 
-	if database.Pool.Where("id = ?", chatHistory.ID).First(&model.Receipt{}).RowsAffected == 0 {
-		response = database.Pool.Create(&chatHistory)
-	} else {
-		response = database.Pool.Model(&model.Receipt{}).Where("id = ?", chatHistory.ID).Updates(chatHistory)
+	notify.BalanceChanged(userID, entry.BalanceAfter)
+	return nil
+}
+
+// fetchChatReceipt builds the receipt of a generation from OpenRouter's stats,
+// with its usage converted to the price we charge.
+func fetchChatReceipt(modelID string, requestID string) (*model.Receipt, error) {
+	responseBody, err := config.FetchGeneration(requestID)
+	if err != nil {
+		return nil, err
+	}
+
+	chatHistory, err := parseChatHistory(responseBody)
+	if err != nil {
+		return nil, err
+	}
+
+	if chatHistory.ModelType == "" {
+		chatHistory.ModelType = modelID
+	}
+
+	// Usage is often not final yet, the nightly reconciliation settles the rest
+	chatHistory.Finalized = chatHistory.Usage > 0
+
+	price := config.GetModelPrice(chatHistory.ModelType)
+	chatHistory.Usage = model.NewCredits(price.Charge(chatHistory.Usage.Float64(), chatHistory.TokensPrompt, chatHistory.TokensCompletion))
+
+	if chatHistory.ID == "" {
+		chatHistory.ID = requestID
 	}
 
-	return database.ProcessDatabaseResponse(response)
+	return chatHistory, nil
 }
 
 func parseChatHistory(responseBody []byte) (*model.Receipt, error) {
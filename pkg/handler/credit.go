@@ -1,9 +1,14 @@
 package handler
 
 import (
+	"log"
+	"time"
+
 	"github.com/gofiber/fiber/v2"
 	gofiberfirebaseauth "github.com/sacsand/gofiber-firebaseauth"
+	"github.com/vndee/lensquery-backend/pkg/config"
 	"github.com/vndee/lensquery-backend/pkg/database"
+	"github.com/vndee/lensquery-backend/pkg/ledger"
 	"github.com/vndee/lensquery-backend/pkg/model"
 )
 
@@ -16,5 +21,108 @@ func GetUserRemainCredits(c *fiber.Ctx) error {
 		return c.SendStatus(fiber.StatusNotFound)
 	}
 
-	return c.Status(fiber.StatusOK).JSON(credits)
+	buckets, err := ledger.Buckets(user.UserID)
+	if err != nil {
+		log.Println("Database:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	details := model.CreditDetails{
+		UserCredits: credits,
+		Buckets:     make([]model.CreditBucketSummary, 0, len(buckets)),
+	}
+	for _, bucket := range buckets {
+		details.Buckets = append(details.Buckets, model.CreditBucketSummary{
+			ID:        bucket.ID,
+			Kind:      bucket.Kind,
+			Granted:   bucket.Granted,
+			Remaining: bucket.Remaining,
+			ExpiresAt: bucket.ExpiresAt,
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(details)
+}
+
+// GetCreditUsageHistory lists the user's charges newest first. Pass the
+// returned next_cursor as cursor to fetch the following page.
+func GetCreditUsageHistory(c *fiber.Ctx) error {
+	user := c.Locals("user").(gofiberfirebaseauth.User)
+
+	params := model.CreditHistoryParams{}
+	if err := c.QueryParser(&params); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	if params.Limit <= 0 {
+		params.Limit = config.CreditHistoryPageSize
+	}
+	if params.Limit > config.CreditHistoryMaxPageSize {
+		params.Limit = config.CreditHistoryMaxPageSize
+	}
+
+	query := database.Pool.Table("credit_usage_histories AS h").
+		Select("h.id, h.request_type, h.amount, h.timestamp, h.generation_id, r.model_type AS model, r.tokens_prompt, r.tokens_completion, r.usage AS cost").
+		Joins("LEFT JOIN receipts AS r ON r.id = h.generation_id AND h.request_type = ?", "chat").
+		Where("h.user_id = ? AND h.deleted_at IS NULL", user.UserID)
+
+	switch params.RequestType {
+	case "":
+	case "text", "equation", "chat", "promo":
+		query = query.Where("h.request_type = ?", params.RequestType)
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Unknown request_type",
+		})
+	}
+
+	if params.From != "" {
+		from, err := parseHistoryTime(params.From)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid from",
+			})
+		}
+		query = query.Where("h.timestamp >= ?", from)
+	}
+
+	if params.To != "" {
+		to, err := parseHistoryTime(params.To)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid to",
+			})
+		}
+		query = query.Where("h.timestamp < ?", to)
+	}
+
+	if params.Cursor > 0 {
+		query = query.Where("h.id < ?", params.Cursor)
+	}
+
+	// Fetch one extra row to know whether another page exists
+	items := []model.CreditHistoryItem{}
+	err := query.Order("h.id DESC").Limit(params.Limit + 1).Scan(&items).Error
+	if err != nil {
+		log.Println("Database:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	result := model.CreditHistoryResponse{Items: items}
+	if len(items) > params.Limit {
+		result.Items = items[:params.Limit]
+		result.NextCursor = result.Items[params.Limit-1].ID
+	}
+
+	return c.Status(fiber.StatusOK).JSON(result)
+}
+
+// parseHistoryTime accepts either an RFC 3339 timestamp or a plain date.
+func parseHistoryTime(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t, nil
+	}
+
+	return time.Parse("2006-01-02", value)
 }
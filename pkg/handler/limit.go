@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	gofiberfirebaseauth "github.com/sacsand/gofiber-firebaseauth"
+	"github.com/vndee/lensquery-backend/pkg/database"
+	"github.com/vndee/lensquery-backend/pkg/ledger"
+	"github.com/vndee/lensquery-backend/pkg/model"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	SpendingCapDaily   = "daily"
+	SpendingCapMonthly = "monthly"
+)
+
+func GetSpendingLimits(c *fiber.Ctx) error {
+	user := c.Locals("user").(gofiberfirebaseauth.User)
+
+	limits, err := getSpendingLimit(user.UserID)
+	if err != nil {
+		log.Println("Database:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(limits)
+}
+
+// UpdateSpendingLimits replaces both caps; a null cap removes it.
+func UpdateSpendingLimits(c *fiber.Ctx) error {
+	user := c.Locals("user").(gofiberfirebaseauth.User)
+
+	params := model.SpendingLimitParams{}
+	if err := c.BodyParser(&params); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	if (params.DailyCap != nil && *params.DailyCap < 0) || (params.MonthlyCap != nil && *params.MonthlyCap < 0) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Caps must not be negative",
+		})
+	}
+
+	limits := model.SpendingLimit{
+		UserID:     user.UserID,
+		DailyCap:   params.DailyCap,
+		MonthlyCap: params.MonthlyCap,
+	}
+	err := database.Pool.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"updated_at", "daily_cap", "monthly_cap"}),
+	}).Create(&limits).Error
+	if err != nil {
+		log.Println("Database:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(limits)
+}
+
+func getSpendingLimit(userID string) (*model.SpendingLimit, error) {
+	limits := model.SpendingLimit{UserID: userID}
+	response := database.Pool.Where("user_id = ?", userID).Limit(1).Find(&limits)
+	if response.Error != nil {
+		return nil, response.Error
+	}
+
+	return &limits, nil
+}
+
+// spendingCaps returns the user's daily and monthly caps, for Reserve to
+// enforce. Days and months are counted in UTC.
+func spendingCaps(userID string) ([]ledger.SpendingCap, error) {
+	limits, err := getSpendingLimit(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	var caps []ledger.SpendingCap
+	if limits.DailyCap != nil {
+		caps = append(caps, ledger.SpendingCap{
+			Name:     SpendingCapDaily,
+			Limit:    *limits.DailyCap,
+			Since:    dayStart,
+			ResetsAt: dayStart.AddDate(0, 0, 1),
+		})
+	}
+	if limits.MonthlyCap != nil {
+		caps = append(caps, ledger.SpendingCap{
+			Name:     SpendingCapMonthly,
+			Limit:    *limits.MonthlyCap,
+			Since:    monthStart,
+			ResetsAt: monthStart.AddDate(0, 1, 0),
+		})
+	}
+
+	return caps, nil
+}
+
+// sendSpendingCapExceeded answers with 429 when err is a spending cap error
+// and reports whether it did.
+func sendSpendingCapExceeded(c *fiber.Ctx, err error) (bool, error) {
+	var capErr *ledger.SpendingCapError
+	if !errors.As(err, &capErr) {
+		return false, nil
+	}
+
+	return true, c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+		"error":     "spending_cap_exceeded",
+		"cap":       capErr.Cap,
+		"limit":     capErr.Limit,
+		"spent":     capErr.Spent,
+		"resets_at": capErr.ResetsAt,
+	})
+}
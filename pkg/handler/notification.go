@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	gofiberfirebaseauth "github.com/sacsand/gofiber-firebaseauth"
+	"github.com/vndee/lensquery-backend/pkg/database"
+	"github.com/vndee/lensquery-backend/pkg/model"
+	"gorm.io/gorm/clause"
+)
+
+func GetNotificationPreferences(c *fiber.Ctx) error {
+	user := c.Locals("user").(gofiberfirebaseauth.User)
+
+	var preference model.NotificationPreference
+	err := database.Pool.Where("user_id = ?", user.UserID).Limit(1).Find(&preference).Error
+	if err != nil {
+		log.Println("Database:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(model.NotificationPreferenceParams{
+		LowBalanceEmails: !preference.LowBalanceOptOut,
+	})
+}
+
+// UpdateNotificationPreferences lets users opt out of low-balance emails.
+func UpdateNotificationPreferences(c *fiber.Ctx) error {
+	user := c.Locals("user").(gofiberfirebaseauth.User)
+
+	params := model.NotificationPreferenceParams{}
+	if err := c.BodyParser(&params); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	preference := model.NotificationPreference{
+		UserID:           user.UserID,
+		LowBalanceOptOut: !params.LowBalanceEmails,
+	}
+	err := database.Pool.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"updated_at", "low_balance_opt_out"}),
+	}).Create(&preference).Error
+	if err != nil {
+		log.Println("Database:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(params)
+}
@@ -3,6 +3,8 @@ package handler
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
@@ -14,10 +16,14 @@ import (
 	vision "cloud.google.com/go/vision/apiv1"
 	"github.com/bytedance/sonic"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
 	gofiberfirebaseauth "github.com/sacsand/gofiber-firebaseauth"
 	"github.com/vndee/lensquery-backend/pkg/config"
 	"github.com/vndee/lensquery-backend/pkg/database"
+	"github.com/vndee/lensquery-backend/pkg/ledger"
 	"github.com/vndee/lensquery-backend/pkg/model"
+	"github.com/vndee/lensquery-backend/pkg/notify"
+	"gorm.io/gorm"
 )
 
 var (
@@ -28,6 +34,7 @@ var (
 
 const NUM_LABELS = 5
 const INTERNAL_SERVER_ERROR = "Internal Server Error"
+const OCR_REQUEST_ID = "ocr_request_id"
 
 // Get short-lived access token
 func GetEquationOCRAppToken(c *fiber.Ctx) error {
@@ -72,11 +79,27 @@ func GetEquationOCRAppToken(c *fiber.Ctx) error {
 
 func GetFreeTextContent(c *fiber.Ctx) error {
 	// Check if user has enough credits
-	if !checkAvailableSnapCredits(c, "text") {
+	if err := checkAvailableSnapCredits(c, "text"); err != nil {
 		log.Printf("User has not enough credits")
 		return c.Status(fiber.StatusPaymentRequired).SendString("Not enough credits")
 	}
 
+	hold, err := reserveSnapCredits(c, "text")
+	if handled, err := sendSpendingCapExceeded(c, err); handled {
+		return err
+	}
+	if errors.Is(err, ledger.ErrInsufficientCredit) {
+		return c.Status(fiber.StatusPaymentRequired).SendString("Not enough credits")
+	}
+	if err != nil {
+		log.Printf("Failed to reserve snap credits: %v", err)
+		return c.Status(fiber.StatusInternalServerError).SendString(INTERNAL_SERVER_ERROR)
+	}
+
+	// Only a successful snap is billed, anything else frees the reservation
+	releaseReason := "request failed"
+	defer func() { releaseSnapCredits(hold, releaseReason) }()
+
 	// Get image from request body
 	file, err := c.FormFile("image")
 	if err != nil {
@@ -113,15 +136,18 @@ func GetFreeTextContent(c *fiber.Ctx) error {
 	annotations, err := client.DetectTexts(ctx, image, nil, 10)
 	if err != nil {
 		log.Printf("Failed to detect texts: %v", err)
+		releaseReason = "text detection failed"
+		results["text"] = ""
+		results["labels"] = []string{}
+		return c.Status(fiber.StatusBadGateway).JSON(results)
+	}
+
+	if len(annotations) == 0 {
+		log.Printf("No text found")
 		results["text"] = ""
 	} else {
-		if len(annotations) == 0 {
-			log.Printf("No text found")
-			results["text"] = ""
-		} else {
-			log.Printf("Found %d text(s)", len(annotations)-1)
-			results["text"] = annotations[0].Description
-		}
+		log.Printf("Found %d text(s)", len(annotations)-1)
+		results["text"] = annotations[0].Description
 	}
 
 	labels, err := client.DetectLabels(ctx, image, nil, NUM_LABELS)
@@ -144,7 +170,7 @@ func GetFreeTextContent(c *fiber.Ctx) error {
 		}
 	}
 
-	err = doDecreaseSnapCredits(c, "text")
+	err = doDecreaseSnapCredits(c, hold, "text")
 	if err != nil {
 		log.Printf("Failed to decrease snap credits: %v", err)
 		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
@@ -154,11 +180,27 @@ func GetFreeTextContent(c *fiber.Ctx) error {
 
 func GetDocumentTextContent(c *fiber.Ctx) error {
 	// Check if user has enough credits
-	if !checkAvailableSnapCredits(c, "text") {
+	if err := checkAvailableSnapCredits(c, "text"); err != nil {
 		log.Printf("User has not enough credits")
 		return c.Status(fiber.StatusPaymentRequired).SendString("Not enough credits")
 	}
 
+	hold, err := reserveSnapCredits(c, "text")
+	if handled, err := sendSpendingCapExceeded(c, err); handled {
+		return err
+	}
+	if errors.Is(err, ledger.ErrInsufficientCredit) {
+		return c.Status(fiber.StatusPaymentRequired).SendString("Not enough credits")
+	}
+	if err != nil {
+		log.Printf("Failed to reserve snap credits: %v", err)
+		return c.Status(fiber.StatusInternalServerError).SendString(INTERNAL_SERVER_ERROR)
+	}
+
+	// Only a successful snap is billed, anything else frees the reservation
+	releaseReason := "request failed"
+	defer func() { releaseSnapCredits(hold, releaseReason) }()
+
 	file, err := c.FormFile("image")
 	if err != nil {
 		log.Println("Image is required")
@@ -190,6 +232,8 @@ func GetDocumentTextContent(c *fiber.Ctx) error {
 
 	annotation, err := client.DetectDocumentText(ctx, image, nil)
 	if err != nil {
+		log.Printf("Failed to detect document text: %v", err)
+		releaseReason = "document text detection failed"
 		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
 	} else {
 		if annotation == nil {
@@ -221,7 +265,7 @@ func GetDocumentTextContent(c *fiber.Ctx) error {
 		}
 	}
 
-	err = doDecreaseSnapCredits(c, "text")
+	err = doDecreaseSnapCredits(c, hold, "text")
 	if err != nil {
 		log.Printf("Failed to decrease snap credits: %v", err)
 		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
@@ -232,11 +276,27 @@ func GetDocumentTextContent(c *fiber.Ctx) error {
 
 func GetEquationTextContent(c *fiber.Ctx) error {
 	// Check if user has enough credits
-	if !checkAvailableSnapCredits(c, "equation") {
+	if err := checkAvailableSnapCredits(c, "equation"); err != nil {
 		log.Printf("User has not enough credits")
 		return c.Status(fiber.StatusPaymentRequired).SendString("Not enough credits")
 	}
 
+	hold, err := reserveSnapCredits(c, "equation")
+	if handled, err := sendSpendingCapExceeded(c, err); handled {
+		return err
+	}
+	if errors.Is(err, ledger.ErrInsufficientCredit) {
+		return c.Status(fiber.StatusPaymentRequired).SendString("Not enough credits")
+	}
+	if err != nil {
+		log.Printf("Failed to reserve snap credits: %v", err)
+		return c.Status(fiber.StatusInternalServerError).SendString(INTERNAL_SERVER_ERROR)
+	}
+
+	// Only a successful snap is billed, anything else frees the reservation
+	releaseReason := "request failed"
+	defer func() { releaseSnapCredits(hold, releaseReason) }()
+
 	file, err := c.FormFile("image")
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).SendString("Image is required")
@@ -294,6 +354,8 @@ func GetEquationTextContent(c *fiber.Ctx) error {
 	client := &http.Client{}
 	response, err := client.Do(req)
 	if err != nil {
+		log.Printf("Failed to send request to Mathpix: %v", err)
+		releaseReason = "mathpix request failed"
 		return c.Status(fiber.StatusInternalServerError).SendString(INTERNAL_SERVER_ERROR)
 	}
 	defer response.Body.Close()
@@ -309,7 +371,19 @@ func GetEquationTextContent(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).SendString(INTERNAL_SERVER_ERROR)
 	}
 
-	err = doDecreaseSnapCredits(c, "equation")
+	if response.StatusCode < http.StatusOK || response.StatusCode >= http.StatusMultipleChoices {
+		log.Printf("Mathpix returned status %d", response.StatusCode)
+		releaseReason = fmt.Sprintf("mathpix status %d", response.StatusCode)
+		return c.Status(response.StatusCode).JSON(responseData)
+	}
+
+	if mathpixError, ok := responseData["error"]; ok && mathpixError != nil {
+		log.Printf("Mathpix returned error: %v", mathpixError)
+		releaseReason = fmt.Sprintf("mathpix error: %v", mathpixError)
+		return c.Status(response.StatusCode).JSON(responseData)
+	}
+
+	err = doDecreaseSnapCredits(c, hold, "equation")
 	if err != nil {
 		log.Printf("Failed to decrease snap credits: %v", err)
 		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
@@ -317,68 +391,103 @@ func GetEquationTextContent(c *fiber.Ctx) error {
 	return c.Status(response.StatusCode).JSON(responseData)
 }
 
-func checkAvailableSnapCredits(c *fiber.Ctx, snapType string) bool {
+func checkAvailableSnapCredits(c *fiber.Ctx, snapType string) error {
 	user := c.Locals("user").(gofiberfirebaseauth.User)
 
-	var userCredits model.UserCredits
-	response := database.Pool.Where("user_id = ?", user.UserID).First(&userCredits)
-	if err := database.ProcessDatabaseResponse(response); err != nil {
-		return false
+	available, err := ledger.Available(user.UserID)
+	if err != nil {
+		return err
+	}
+
+	if available < snapPrice(snapType) {
+		return ledger.ErrInsufficientCredit
 	}
 
+	return nil
+}
+
+func snapPrice(snapType string) model.Credits {
 	switch snapType {
 	case "equation":
-		if userCredits.CreditAmount < config.EquationTextSnapPrice {
-			return false
-		}
-
+		return model.NewCredits(config.EquationTextSnapPrice)
 	case "text":
-		if userCredits.CreditAmount < config.FreeTextSnapPrice {
-			return false
-		}
+		return model.NewCredits(config.FreeTextSnapPrice)
 	}
-	return true
+
+	return 0
 }
 
-func doDecreaseSnapCredits(c *fiber.Ctx, snapType string) error {
+func reserveSnapCredits(c *fiber.Ctx, snapType string) (*model.CreditHold, error) {
 	user := c.Locals("user").(gofiberfirebaseauth.User)
 
-	var userCredits model.UserCredits
-	response := database.Pool.Where("user_id = ?", user.UserID).First(&userCredits)
-	if err := database.ProcessDatabaseResponse(response); err != nil {
-		return err
+	caps, err := spendingCaps(user.UserID)
+	if err != nil {
+		return nil, err
 	}
 
-	switch snapType {
-	case "equation":
-		response := database.Pool.Model(&model.UserCredits{}).Where("user_id = ?", user.UserID).Update("credit_amount", userCredits.CreditAmount-config.EquationTextSnapPrice)
-		if err := database.ProcessDatabaseResponse(response); err != nil {
-			return err
-		}
+	return ledger.Reserve(user.UserID, snapPrice(snapType), config.SnapHoldTTL, caps...)
+}
 
-		return addDecreaseSnapCreditsHistory(c, snapType, config.EquationTextSnapPrice)
-	case "text":
-		response := database.Pool.Model(&model.UserCredits{}).Where("user_id = ?", user.UserID).Update("credit_amount", userCredits.CreditAmount-config.FreeTextSnapPrice)
-		if err := database.ProcessDatabaseResponse(response); err != nil {
+func releaseSnapCredits(hold *model.CreditHold, reason string) {
+	if err := ledger.Release(hold.ID, reason); err != nil {
+		log.Printf("Failed to release snap credits: %v", err)
+	}
+}
+
+// doDecreaseSnapCredits settles the snap reservation into a ledger charge.
+func doDecreaseSnapCredits(c *fiber.Ctx, hold *model.CreditHold, snapType string) error {
+	user := c.Locals("user").(gofiberfirebaseauth.User)
+	price := snapPrice(snapType)
+
+	var entry *model.LedgerEntry
+	err := database.Pool.Transaction(func(tx *gorm.DB) error {
+		var err error
+		entry, err = ledger.SettleTx(tx, hold.ID, ledger.Posting{
+			UserID:       user.UserID,
+			EntryType:    ledger.EntrySnap,
+			Amount:       -price,
+			Counterparty: ledger.AccountRevenue,
+			SourceType:   ledger.SourceOCRRequest,
+			SourceID:     getOCRRequestID(c),
+			Memo:         snapType,
+		})
+		if err != nil {
 			return err
 		}
 
-		return addDecreaseSnapCreditsHistory(c, snapType, config.FreeTextSnapPrice)
+		return addDecreaseSnapCreditsHistory(tx, c, snapType, price)
+	})
+	if err != nil {
+		return err
 	}
 
+	notify.BalanceChanged(user.UserID, entry.BalanceAfter)
 	return nil
 }
 
-func addDecreaseSnapCreditsHistory(c *fiber.Ctx, snapType string, ammount float64) error {
+func addDecreaseSnapCreditsHistory(tx *gorm.DB, c *fiber.Ctx, snapType string, ammount model.Credits) error {
 	user := c.Locals("user").(gofiberfirebaseauth.User)
 
 	var creditHistory model.CreditUsageHistory = model.CreditUsageHistory{
 		UserID:      user.UserID,
 		RequestType: snapType,
-		Amount:      float64(ammount),
+		Amount:      ammount,
 		Timestamp:   time.Now(),
 	}
 
-	response := database.Pool.Create(&creditHistory)
+	response := tx.Create(&creditHistory)
 	return database.ProcessDatabaseResponse(response)
 }
+
+// getOCRRequestID returns the ID linking this OCR request to its ledger entry,
+// generating it on first use and echoing it back in the response headers.
+func getOCRRequestID(c *fiber.Ctx) string {
+	if requestID, ok := c.Locals(OCR_REQUEST_ID).(string); ok {
+		return requestID
+	}
+
+	requestID := utils.UUIDv4()
+	c.Locals(OCR_REQUEST_ID, requestID)
+	c.Set(fiber.HeaderXRequestID, requestID)
+	return requestID
+}
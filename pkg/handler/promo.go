@@ -0,0 +1,248 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	gofiberfirebaseauth "github.com/sacsand/gofiber-firebaseauth"
+	"github.com/shareed2k/go_limiter"
+	"github.com/vndee/lensquery-backend/pkg/config"
+	"github.com/vndee/lensquery-backend/pkg/database"
+	"github.com/vndee/lensquery-backend/pkg/ledger"
+	"github.com/vndee/lensquery-backend/pkg/limiter"
+	"github.com/vndee/lensquery-backend/pkg/model"
+	"github.com/vndee/lensquery-backend/pkg/subscription"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var limiterPromoConfig *go_limiter.Limit = &go_limiter.Limit{
+	Algorithm: go_limiter.SlidingWindowAlgorithm,
+	Rate:      config.PromoLimiterRate,
+	Burst:     config.PromoLimiterBurst,
+	Period:    config.PromoLimiterPeriod,
+}
+
+// promoError is a redemption failure reported back to the user as is.
+type promoError struct {
+	status  int
+	message string
+}
+
+func (e *promoError) Error() string {
+	return e.message
+}
+
+func CreatePromoCode(c *fiber.Ctx) error {
+	user := c.Locals("user").(gofiberfirebaseauth.User)
+
+	params := model.CreatePromoCodeParams{}
+	if err := c.BodyParser(&params); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	params.Code = strings.ToUpper(strings.TrimSpace(params.Code))
+	if params.Code == "" || params.Amount <= 0 || params.MaxRedemptions < 0 || params.PerUserLimit < 0 {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	if params.PerUserLimit == 0 {
+		params.PerUserLimit = 1
+	}
+
+	promo := model.PromoCode{
+		Code:               params.Code,
+		Amount:             params.Amount,
+		MaxRedemptions:     params.MaxRedemptions,
+		PerUserLimit:       params.PerUserLimit,
+		ValidFrom:          params.ValidFrom,
+		ValidUntil:         params.ValidUntil,
+		TargetPlan:         params.TargetPlan,
+		CreditValidityDays: params.CreditValidityDays,
+		CreatedBy:          user.UserID,
+	}
+
+	if database.Pool.Where("code = ?", promo.Code).Limit(1).Find(&model.PromoCode{}).RowsAffected > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Promo code already exists",
+		})
+	}
+
+	err := database.Pool.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&promo).Error; err != nil {
+			return err
+		}
+
+		return recordAudit(tx, user.UserID, AuditCreatePromoCode, "", "", promo)
+	})
+	if err != nil {
+		log.Println("Database:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(promo)
+}
+
+func ListPromoCodes(c *fiber.Ctx) error {
+	var promos []model.PromoCode
+	err := database.Pool.Order("id DESC").Find(&promos).Error
+	if err != nil {
+		log.Println("Database:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(promos)
+}
+
+func RedeemPromoCode(c *fiber.Ctx) error {
+	user := c.Locals("user").(gofiberfirebaseauth.User)
+
+	params := model.RedeemPromoCodeParams{}
+	if err := c.BodyParser(&params); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	code := strings.ToUpper(strings.TrimSpace(params.Code))
+	if code == "" {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	// Slow down code guessing
+	res, err := limiter.Limiter.Allow(c.Context(), "PROMO_"+user.UserID, limiterPromoConfig)
+	if err != nil {
+		log.Println("Limiter:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	if !res.Allowed {
+		return c.SendStatus(fiber.StatusTooManyRequests)
+	}
+
+	var redemption model.PromoRedemption
+	err = database.Pool.Transaction(func(tx *gorm.DB) error {
+		var promo model.PromoCode
+		response := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("code = ?", code).Limit(1).Find(&promo)
+		if response.Error != nil {
+			return response.Error
+		}
+		if response.RowsAffected == 0 {
+			return &promoError{fiber.StatusNotFound, "Unknown promo code"}
+		}
+
+		now := time.Now()
+		if (promo.ValidFrom != nil && now.Before(*promo.ValidFrom)) || (promo.ValidUntil != nil && now.After(*promo.ValidUntil)) {
+			return &promoError{fiber.StatusBadRequest, "Promo code is not valid at this time"}
+		}
+
+		if promo.MaxRedemptions > 0 && promo.Redemptions >= promo.MaxRedemptions {
+			return &promoError{fiber.StatusConflict, "Promo code has been fully redeemed"}
+		}
+
+		var redeemed int64
+		err := tx.Model(&model.PromoRedemption{}).Where("promo_code_id = ? AND user_id = ?", promo.ID, user.UserID).Count(&redeemed).Error
+		if err != nil {
+			return err
+		}
+		if redeemed >= int64(promo.PerUserLimit) {
+			return &promoError{fiber.StatusConflict, "Promo code already redeemed"}
+		}
+
+		if promo.TargetPlan != "" {
+			eligible, err := hasPurchasedPlan(tx, user.UserID, promo.TargetPlan)
+			if err != nil {
+				return err
+			}
+			if !eligible {
+				return &promoError{fiber.StatusForbidden, "Promo code is not available for your plan"}
+			}
+		}
+
+		redemption = model.PromoRedemption{
+			PromoCodeID: promo.ID,
+			UserID:      user.UserID,
+			Amount:      promo.Amount,
+		}
+		if err := tx.Create(&redemption).Error; err != nil {
+			return err
+		}
+
+		var expiresAt *time.Time
+		if promo.CreditValidityDays > 0 {
+			expiry := now.AddDate(0, 0, promo.CreditValidityDays)
+			expiresAt = &expiry
+		}
+
+		entry, err := ledger.PostTx(tx, ledger.Posting{
+			UserID:       user.UserID,
+			EntryType:    ledger.EntryPromo,
+			Amount:       promo.Amount,
+			Counterparty: ledger.AccountPromotions,
+			SourceType:   ledger.SourcePromoRedemption,
+			SourceID:     strconv.FormatUint(uint64(redemption.ID), 10),
+			Memo:         promo.Code,
+			Bucket:       ledger.BucketPromotional,
+			ExpiresAt:    expiresAt,
+		})
+		if err != nil {
+			return err
+		}
+
+		redemption.LedgerEntryID = entry.ID
+		err = tx.Model(&model.PromoRedemption{}).Where("id = ?", redemption.ID).Update("ledger_entry_id", entry.ID).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Create(&model.CreditUsageHistory{
+			UserID:      user.UserID,
+			Amount:      promo.Amount,
+			Timestamp:   now,
+			RequestType: "promo",
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&model.PromoCode{}).Where("id = ?", promo.ID).Update("redemptions", gorm.Expr("redemptions + 1")).Error
+	})
+
+	var redeemErr *promoError
+	if errors.As(err, &redeemErr) {
+		return c.Status(redeemErr.status).JSON(fiber.Map{
+			"error": redeemErr.message,
+		})
+	}
+	if err != nil {
+		log.Println("Redeem promo code:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"amount": redemption.Amount,
+	})
+}
+
+// hasPurchasedPlan reports whether the user is subscribed to the given plan
+// product, or ever bought it as a credit pack.
+func hasPurchasedPlan(tx *gorm.DB, userID string, plan string) (bool, error) {
+	var sub model.Subscription
+	err := tx.Where("user_id = ? AND product_id = ?", userID, plan).Limit(1).Find(&sub).Error
+	if err != nil {
+		return false, err
+	}
+	if sub.Model != nil {
+		if entitled, _ := subscription.Entitled(sub, time.Now().UnixMilli()); entitled {
+			return true, nil
+		}
+	}
+
+	var purchases int64
+	err = tx.Model(&model.LedgerEntry{}).
+		Where("user_id = ? AND entry_type = ? AND memo = ?", userID, ledger.EntryPurchase, plan).
+		Count(&purchases).Error
+
+	return purchases > 0, err
+}
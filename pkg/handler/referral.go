@@ -0,0 +1,293 @@
+package handler
+
+import (
+	"crypto/rand"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5/pgconn"
+	gofiberfirebaseauth "github.com/sacsand/gofiber-firebaseauth"
+	"github.com/vndee/lensquery-backend/pkg/config"
+	"github.com/vndee/lensquery-backend/pkg/database"
+	"github.com/vndee/lensquery-backend/pkg/ledger"
+	"github.com/vndee/lensquery-backend/pkg/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const DEVICE_ID_HEADER = "X-Device-ID"
+
+// Referral statuses
+const (
+	ReferralPending  = "PENDING"
+	ReferralRewarded = "REWARDED"
+)
+
+// Referral reward triggers
+const (
+	ReferralTriggerTrial    = "TRIAL"
+	ReferralTriggerPurchase = "PURCHASE"
+)
+
+func GetReferralCode(c *fiber.Ctx) error {
+	user := c.Locals("user").(gofiberfirebaseauth.User)
+
+	var referralCode model.ReferralCode
+	response := database.Pool.Where("user_id = ?", user.UserID).Limit(1).Find(&referralCode)
+	if response.Error != nil {
+		log.Println("Database:", response.Error)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	if response.RowsAffected == 0 {
+		code, err := generateReferralCode(config.ReferralCodeLength)
+		if err != nil {
+			log.Println("Generate code:", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		referralCode = model.ReferralCode{
+			UserID:   user.UserID,
+			Code:     code,
+			Email:    normalizeEmail(user.Email),
+			DeviceID: c.Get(DEVICE_ID_HEADER),
+		}
+		err = database.Pool.Create(&referralCode).Error
+		if err != nil {
+			log.Println("Database:", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"code": referralCode.Code,
+	})
+}
+
+// ApplyReferralCode links a new user to the owner of the code. Rewards are
+// paid once the user activates their trial or makes a first purchase.
+func ApplyReferralCode(c *fiber.Ctx) error {
+	user := c.Locals("user").(gofiberfirebaseauth.User)
+
+	params := model.ApplyReferralCodeParams{}
+	if err := c.BodyParser(&params); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	code := strings.ToUpper(strings.TrimSpace(params.Code))
+	if code == "" {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	deviceID := params.DeviceID
+	if deviceID == "" {
+		deviceID = c.Get(DEVICE_ID_HEADER)
+	}
+
+	var referralCode model.ReferralCode
+	response := database.Pool.Where("code = ?", code).First(&referralCode)
+	if err := database.ProcessDatabaseResponse(response); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Unknown referral code",
+		})
+	}
+
+	email := normalizeEmail(user.Email)
+
+	// No self-referral by account, email or device
+	if referralCode.UserID == user.UserID || (email != "" && referralCode.Email == email) ||
+		(deviceID != "" && referralCode.DeviceID == deviceID) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Referral code cannot be used by its owner",
+		})
+	}
+
+	var existing int64
+	err := database.Pool.Model(&model.Referral{}).Where("referee_id = ?", user.UserID).Count(&existing).Error
+	if err != nil {
+		log.Println("Database:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	if existing > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "A referral code has already been applied",
+		})
+	}
+
+	// Only new users can be referred
+	var activity int64
+	err = database.Pool.Model(&model.LedgerEntry{}).
+		Where("user_id = ? AND entry_type IN ?", user.UserID, []string{ledger.EntryTrial, ledger.EntryPurchase}).
+		Count(&activity).Error
+	if err != nil {
+		log.Println("Database:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	if activity > 0 {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Referral codes are only available to new users",
+		})
+	}
+
+	// One device cannot be referred twice
+	if deviceID != "" {
+		var deviceReferrals int64
+		err = database.Pool.Model(&model.Referral{}).Where("device_id = ?", deviceID).Count(&deviceReferrals).Error
+		if err != nil {
+			log.Println("Database:", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if deviceReferrals > 0 {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "This device has already been referred",
+			})
+		}
+	}
+
+	// Nor one inbox, whichever account it signs in with
+	if email != "" {
+		var emailReferrals int64
+		err = database.Pool.Model(&model.Referral{}).Where("referee_email = ?", email).Count(&emailReferrals).Error
+		if err != nil {
+			log.Println("Database:", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if emailReferrals > 0 {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "This email has already been referred",
+			})
+		}
+	}
+
+	err = database.Pool.Create(&model.Referral{
+		ReferrerID:   referralCode.UserID,
+		RefereeID:    user.UserID,
+		RefereeEmail: email,
+		DeviceID:     deviceID,
+		Status:       ReferralPending,
+	}).Error
+	if isUniqueViolation(err) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "A referral code has already been applied",
+		})
+	}
+	if err != nil {
+		log.Println("Database:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// rewardReferral pays out the pending referral of the user, if any. The
+// referee is always rewarded, the referrer only until the reward cap.
+func rewardReferral(userID string, trigger string) error {
+	return database.Pool.Transaction(func(tx *gorm.DB) error {
+		var referral model.Referral
+		response := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("referee_id = ? AND status = ?", userID, ReferralPending).Limit(1).Find(&referral)
+		if response.Error != nil || response.RowsAffected == 0 {
+			return response.Error
+		}
+
+		sourceID := strconv.FormatUint(uint64(referral.ID), 10)
+		_, err := ledger.PostTx(tx, ledger.Posting{
+			UserID:       referral.RefereeID,
+			EntryType:    ledger.EntryReferral,
+			Amount:       model.NewCredits(config.RefereeBonusCredits),
+			Counterparty: ledger.AccountPromotions,
+			SourceType:   ledger.SourceReferral,
+			SourceID:     sourceID + ":referee",
+			Memo:         trigger,
+			Bucket:       ledger.BucketPromotional,
+		})
+		if err != nil && !errors.Is(err, ledger.ErrDuplicateEntry) {
+			return err
+		}
+
+		// Rewards of the same referrer are counted one at a time against the cap
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ?", referral.ReferrerID).Limit(1).Find(&model.ReferralCode{}).Error
+		if err != nil {
+			return err
+		}
+
+		var rewarded int64
+		err = tx.Model(&model.Referral{}).Where("referrer_id = ? AND status = ?", referral.ReferrerID, ReferralRewarded).Count(&rewarded).Error
+		if err != nil {
+			return err
+		}
+
+		if rewarded < config.ReferralRewardCap {
+			_, err = ledger.PostTx(tx, ledger.Posting{
+				UserID:       referral.ReferrerID,
+				EntryType:    ledger.EntryReferral,
+				Amount:       model.NewCredits(config.ReferrerBonusCredits),
+				Counterparty: ledger.AccountPromotions,
+				SourceType:   ledger.SourceReferral,
+				SourceID:     sourceID + ":referrer",
+				Memo:         trigger,
+				Bucket:       ledger.BucketPromotional,
+			})
+			if err != nil && !errors.Is(err, ledger.ErrDuplicateEntry) {
+				return err
+			}
+		} else {
+			log.Printf("Referrer %s reached the reward cap", referral.ReferrerID)
+		}
+
+		now := time.Now()
+		return tx.Model(&model.Referral{}).Where("id = ?", referral.ID).Updates(map[string]interface{}{
+			"status":      ReferralRewarded,
+			"trigger":     trigger,
+			"rewarded_at": &now,
+		}).Error
+	})
+}
+
+// isUniqueViolation reports whether err comes from a unique index, which
+// catches the requests that raced past the checks above.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// normalizeEmail folds address variants that reach the same inbox.
+func normalizeEmail(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+
+	local, domain := email[:at], email[at+1:]
+	if plus := strings.Index(local, "+"); plus >= 0 {
+		local = local[:plus]
+	}
+	if domain == "gmail.com" || domain == "googlemail.com" {
+		local = strings.ReplaceAll(local, ".", "")
+		domain = "gmail.com"
+	}
+
+	return local + "@" + domain
+}
+
+func generateReferralCode(length int) (string, error) {
+	const charset = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	code := make([]byte, length)
+
+	_, err := rand.Read(code)
+	if err != nil {
+		return "", err
+	}
+
+	for i := range code {
+		code[i] = charset[code[i]%byte(len(charset))]
+	}
+
+	return string(code), nil
+}
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"errors"
+	"log"
+
+	"github.com/bytedance/sonic"
+	"github.com/vndee/lensquery-backend/pkg/config"
+	"github.com/vndee/lensquery-backend/pkg/database"
+	"github.com/vndee/lensquery-backend/pkg/ledger"
+	"github.com/vndee/lensquery-backend/pkg/model"
+	"gorm.io/gorm"
+)
+
+const FlagRepeatedRefunds = "REPEATED_REFUNDS"
+
+// clawBackRefund reverses the credits granted by the refunded store
+// transaction, draining the bucket of the purchase first. The balance may go
+// negative when the credits were already spent.
+func clawBackRefund(event *model.Event) error {
+	if event.TransactionID == "" {
+		return nil
+	}
+
+	var purchases []model.LedgerEntry
+	err := database.Pool.Table("ledger_entries AS l").
+		Select("l.*").
+		Joins("JOIN webhook_events AS w ON w.id = l.source_id").
+		Where("l.entry_type = ? AND l.source_type = ? AND w.transaction_id = ?", ledger.EntryPurchase, ledger.SourceWebhookEvent, event.TransactionID).
+		Scan(&purchases).Error
+	if err != nil {
+		return err
+	}
+
+	// Subscription refunds have no credits to take back
+	for _, purchase := range purchases {
+		var userID string
+		err := database.Pool.Transaction(func(tx *gorm.DB) error {
+			// The purchase may have been made under an alias merged since
+			var err error
+			userID, err = resolveUserID(tx, purchase.UserID)
+			if err != nil {
+				return err
+			}
+
+			var bucket model.CreditBucket
+			err = tx.Where("ledger_entry_id = ?", purchase.ID).Limit(1).Find(&bucket).Error
+			if err != nil {
+				return err
+			}
+
+			var bucketID uint
+			if bucket.Model != nil {
+				bucketID = bucket.ID
+			}
+
+			_, err = ledger.PostTx(tx, ledger.Posting{
+				UserID:         userID,
+				EntryType:      ledger.EntryRefund,
+				Amount:         -purchase.Amount,
+				Counterparty:   ledger.StoreAccount(event.Store),
+				SourceType:     ledger.SourceStoreTransaction,
+				SourceID:       event.TransactionID,
+				Memo:           event.ProductID,
+				AllowOverdraft: true,
+				FromBucket:     bucketID,
+				Environment:    event.Environment,
+			})
+			if err != nil {
+				return err
+			}
+
+			return flagRepeatedRefunds(tx, userID)
+		})
+
+		// A redelivered refund has already been clawed back
+		if errors.Is(err, ledger.ErrDuplicateEntry) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Clawed back %s credits from %s for refunded transaction %s", purchase.Amount, userID, event.TransactionID)
+	}
+
+	return nil
+}
+
+// flagRepeatedRefunds flags the account for review once its refunds reach
+// config.RefundReviewThreshold, unless it is already flagged for them.
+func flagRepeatedRefunds(tx *gorm.DB, userID string) error {
+	var refunds int64
+	err := tx.Model(&model.LedgerEntry{}).Where("user_id = ? AND entry_type = ?", userID, ledger.EntryRefund).Count(&refunds).Error
+	if err != nil {
+		return err
+	}
+	if refunds < config.RefundReviewThreshold {
+		return nil
+	}
+
+	var open int64
+	err = tx.Model(&model.AccountFlag{}).Where("user_id = ? AND reason = ? AND resolved_at IS NULL", userID, FlagRepeatedRefunds).Count(&open).Error
+	if err != nil || open > 0 {
+		return err
+	}
+
+	details, err := sonic.Marshal(map[string]interface{}{
+		"refunds": refunds,
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Create(&model.AccountFlag{
+		UserID:  userID,
+		Reason:  FlagRepeatedRefunds,
+		Details: string(details),
+	}).Error
+}
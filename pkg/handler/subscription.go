@@ -2,49 +2,260 @@ package handler
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
-	"os"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	gofiberfirebaseauth "github.com/sacsand/gofiber-firebaseauth"
 	"github.com/vndee/lensquery-backend/pkg/config"
 	"github.com/vndee/lensquery-backend/pkg/database"
 	"github.com/vndee/lensquery-backend/pkg/email"
+	"github.com/vndee/lensquery-backend/pkg/ledger"
 	"github.com/vndee/lensquery-backend/pkg/model"
+	"github.com/vndee/lensquery-backend/pkg/subscription"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+func isCreditPack(store string, productID string) bool {
+	return (*config.StorePackages)[store][productID] != 0
+}
+
 func handleNonRenewingPurchase(event *model.Event) (*model.UserCredits, error) {
-	var response *gorm.DB
 	addedAmount := (*config.StorePackages)[event.Store][event.ProductID]
 	if addedAmount == 0 {
 		return nil, fmt.Errorf("unknown product")
 	}
 
-	var userCredits model.UserCredits
-	response = database.Pool.Where("user_id = ?", event.AppUserID).First(&userCredits)
+	err := database.Pool.Transaction(func(tx *gorm.DB) error {
+		// The same transaction may arrive through RevenueCat and from Apple
+		credited, err := transactionCredited(tx, event)
+		if err != nil {
+			return err
+		}
+		if credited {
+			return ledger.ErrDuplicateEntry
+		}
 
-	if response.RowsAffected == 0 {
-		response = database.Pool.Create(&model.UserCredits{
-			UserID:               event.AppUserID,
-			PurchasedTimestampMs: event.PurchasedAtMs,
-			CreditAmount:         float64(addedAmount),
-		})
-	} else {
-		response = database.Pool.Model(&userCredits).Where("user_id = ?", event.AppUserID).Updates(map[string]interface{}{
-			"credit_amount": userCredits.CreditAmount + float64(addedAmount),
+		_, err = ledger.PostTx(tx, ledger.Posting{
+			UserID:       event.AppUserID,
+			EntryType:    ledger.EntryPurchase,
+			Amount:       model.NewCredits(float64(addedAmount)),
+			Counterparty: ledger.StoreAccount(event.Store),
+			SourceType:   ledger.SourceWebhookEvent,
+			SourceID:     event.ID,
+			Memo:         event.ProductID,
+			Bucket:       ledger.BucketPurchased,
+			Environment:  event.Environment,
 		})
+		if err != nil {
+			return err
+		}
+
+		response := tx.Model(&model.UserCredits{}).Where("user_id = ?", event.AppUserID).Update("purchased_timestamp_ms", event.PurchasedAtMs)
+		return database.ProcessDatabaseResponse(response)
+	})
+
+	// A redelivered event has already been credited
+	if err != nil && !errors.Is(err, ledger.ErrDuplicateEntry) {
+		return nil, err
+	}
+
+	if err == nil {
+		if err := rewardReferral(event.AppUserID, ReferralTriggerPurchase); err != nil {
+			log.Println("Reward referral:", err)
+		}
 	}
 
+	var userCredits model.UserCredits
+	response := database.Pool.Where("user_id = ?", event.AppUserID).First(&userCredits)
 	return &userCredits, database.ProcessDatabaseResponse(response)
 }
 
+// transactionCredited reports whether another event already credited the
+// store transaction of event.
+func transactionCredited(tx *gorm.DB, event *model.Event) (bool, error) {
+	if event.TransactionID == "" {
+		return false, nil
+	}
+
+	var credited int64
+	err := tx.Table("ledger_entries AS l").
+		Joins("JOIN webhook_events AS w ON w.id = l.source_id").
+		Where("l.entry_type = ? AND l.source_type = ? AND w.transaction_id = ? AND w.id <> ?", ledger.EntryPurchase, ledger.SourceWebhookEvent, event.TransactionID, event.ID).
+		Count(&credited).Error
+
+	return credited > 0, err
+}
+
+// updateSubscription applies a subscription event to the user's stored
+// subscription and reports whether the event changed it.
+func updateSubscription(event *model.Event) (*model.Subscription, bool, error) {
+	var sub model.Subscription
+	var changed bool
+
+	err := database.Pool.Transaction(func(tx *gorm.DB) error {
+		current, err := lockSubscription(tx, event.AppUserID)
+		if err != nil {
+			return err
+		}
+
+		sub, changed = subscription.Apply(current, event, config.GetPlan)
+		if !changed {
+			return nil
+		}
+
+		return saveSubscription(tx, &sub)
+	})
+
+	return &sub, changed, err
+}
+
+func lockSubscription(tx *gorm.DB, userID string) (model.Subscription, error) {
+	var sub model.Subscription
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ?", userID).Limit(1).Find(&sub).Error
+	return sub, err
+}
+
+func saveSubscription(tx *gorm.DB, sub *model.Subscription) error {
+	if sub.Model != nil && sub.ID != 0 {
+		return tx.Save(sub).Error
+	}
+
+	return tx.Create(sub).Error
+}
+
+// handleSubscriptionStatusEvent covers the events that only change the state
+// of the subscription, and emails the user when it did change.
+func handleSubscriptionStatusEvent(event *model.Event) (*model.UserCredits, error) {
+	sub, changed, err := updateSubscription(event)
+	if err != nil {
+		return nil, err
+	}
+
+	if changed {
+		sendEmail(event.Type, event.AppUserID, subscriptionEmailData(event, sub))
+	}
+
+	return nil, nil
+}
+
+// handleTransferEvent moves the subscriptions of the users in
+// transferred_from to the first user in transferred_to.
+func handleTransferEvent(event *model.Event) (*model.UserCredits, error) {
+	if len(event.TransferredFrom) == 0 || len(event.TransferredTo) == 0 {
+		return nil, fmt.Errorf("transfer event without users")
+	}
+
+	var revokedSubs []model.Subscription
+	err := database.Pool.Transaction(func(tx *gorm.DB) error {
+		revokedSubs = nil
+
+		toUserID, err := resolveUserID(tx, event.TransferredTo[0])
+		if err != nil {
+			return err
+		}
+
+		for _, fromUserID := range event.TransferredFrom {
+			fromUserID, err := resolveUserID(tx, fromUserID)
+			if err != nil {
+				return err
+			}
+			if fromUserID == toUserID {
+				continue
+			}
+
+			current, err := lockSubscription(tx, fromUserID)
+			if err != nil {
+				return err
+			}
+			if current.Model == nil || current.Status == subscription.StatusExpired {
+				continue
+			}
+
+			receiver, err := lockSubscription(tx, toUserID)
+			if err != nil {
+				return err
+			}
+
+			moved, revoked := subscription.Transfer(current, toUserID, event)
+			moved.Model = receiver.Model
+
+			if err := saveSubscription(tx, &revoked); err != nil {
+				return err
+			}
+			if err := saveSubscription(tx, &moved); err != nil {
+				return err
+			}
+			revokedSubs = append(revokedSubs, revoked)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Tell previous owners, since a restore on someone else's device is how
+	// a subscription gets taken over
+	for i := range revokedSubs {
+		sendEmail(event.Type, revokedSubs[i].UserID, subscriptionEmailData(event, &revokedSubs[i]))
+	}
+
+	return nil, nil
+}
+
+func subscriptionEmailData(event *model.Event, sub *model.Subscription) model.EmailData {
+	data := model.EmailData{
+		SubscriptionPlan: planName(event.Store, sub.ProductID),
+		TransactionID:    event.TransactionID,
+		PurchaseTime:     formatEventTime(sub.PurchasedAtMs),
+		ExpirationTime:   formatEventTime(sub.ExpirationAtMs),
+		Price:            fmt.Sprintf("%.2f %s", event.PriceInPurchasedCurrency, event.Currency),
+	}
+
+	switch event.Type {
+	case "BILLING_ISSUE":
+		data.ExpirationTime = formatEventTime(sub.GracePeriodExpiresAtMs)
+	case "PRODUCT_CHANGE":
+		data.SubscriptionPlan = planName(event.Store, event.ProductID)
+		data.NewPlan = planName(event.Store, event.NewProductID)
+	case "TRANSFER":
+		// Transfer events carry no store or product of their own
+		data.SubscriptionPlan = planName(sub.Store, sub.ProductID)
+		data.TransactionID = sub.TransactionID
+	case "SUBSCRIPTION_PAUSED":
+		if sub.AutoResumeAtMs > 0 {
+			data.ResumeTime = formatEventTime(sub.AutoResumeAtMs)
+		}
+	}
+
+	return data
+}
+
+func planName(store string, productID string) string {
+	if plan, ok := config.GetPlan(store, productID); ok && plan.Name != "" {
+		return plan.Name
+	}
+
+	return productID
+}
+
+func formatEventTime(ms int64) string {
+	return time.Unix(ms/1000, 0).Format("2006-01-02 15:04:05")
+}
+
 func handleTestEvent(event *model.Event) {
 
 }
 
 func handleInitialPurchaseEvent(event *model.Event) (*model.UserCredits, error) {
+	if _, _, err := updateSubscription(event); err != nil {
+		return nil, err
+	}
+
 	// var plan config.Plan
 	// if event.Store == "APP_STORE" {
 	// 	plan = config.AppStorePlanConfigs[event.ProductID]
@@ -78,25 +289,15 @@ func handleInitialPurchaseEvent(event *model.Event) (*model.UserCredits, error)
 }
 
 func handleExpirationEvent(event *model.Event) (*model.UserCredits, error) {
-	// plan := config.PlanConfigs[event.ProductID]
-
-	userCredits := model.UserCredits{
-		UserID:               event.AppUserID,
-		PurchasedTimestampMs: event.PurchasedAtMs,
+	// The plan ends with the subscription, purchased credits stay untouched
+	if _, _, err := updateSubscription(event); err != nil {
+		return nil, err
 	}
 
-	var response *gorm.DB
-	if database.Pool.Where("user_id = ?", event.AppUserID).First(&model.UserCredits{}).RowsAffected == 0 {
-		response = database.Pool.Create(&userCredits)
-	} else {
-		response = database.Pool.Model(&model.UserCredits{}).Where("user_id = ?", event.AppUserID).Updates(map[string]interface{}{
-			"expired_timestamp_ms":  event.ExpirationAtMs,
-			"ammount_equation_snap": 0,
-			"remain_equation_snap":  0,
-			"ammount_text_snap":     0,
-			"remain_text_snap":      0,
-		})
-	}
+	// plan := config.PlanConfigs[event.ProductID]
+
+	var userCredits model.UserCredits
+	response := database.Pool.Where("user_id = ?", event.AppUserID).Limit(1).Find(&userCredits)
 
 	// sendEmail(event.Type, event.AppUserID, model.EmailData{
 	// 	SubscriptionPlan: plan.Name,
@@ -105,10 +306,14 @@ func handleExpirationEvent(event *model.Event) (*model.UserCredits, error) {
 	// 	ExpirationTime:   time.Unix(event.ExpirationAtMs/1000, 0).Format("2006-01-02 15:04:05"),
 	// 	Price:            fmt.Sprintf("%.2f %s", event.PriceInPurchasedCurrency, event.Currency),
 	// })
-	return &userCredits, database.ProcessDatabaseResponse(response)
+	return &userCredits, response.Error
 }
 
 func handleRenewalEvent(event *model.Event) (*model.UserCredits, error) {
+	if _, _, err := updateSubscription(event); err != nil {
+		return nil, err
+	}
+
 	// var plan config.Plan
 	// if event.Store == "APP_STORE" {
 	// 	plan = config.AppStorePlanConfigs[event.ProductID]
@@ -141,6 +346,24 @@ func handleRenewalEvent(event *model.Event) (*model.UserCredits, error) {
 }
 
 func handleCancelationEvent(event *model.Event) (*model.UserCredits, error) {
+	// Credit packs are cancelled only by refunds and have no subscription
+	if !isCreditPack(event.Store, event.ProductID) {
+		if _, _, err := updateSubscription(event); err != nil {
+			return nil, err
+		}
+	}
+
+	if event.CancelReason == subscription.CancelReasonRefund {
+		if err := clawBackRefund(event); err != nil {
+			return nil, err
+		}
+	}
+
+	// The cancellation email is about a subscription plan, refunded packs get none
+	if isCreditPack(event.Store, event.ProductID) {
+		return nil, nil
+	}
+
 	var plan config.Plan
 	if event.Store == "APP_STORE" {
 		plan = config.AppStorePlanConfigs[event.ProductID]
@@ -160,71 +383,144 @@ func handleCancelationEvent(event *model.Event) (*model.UserCredits, error) {
 	return nil, nil
 }
 
-func EventHook(c *fiber.Ctx) error {
-	// Check API Bearer token in the header
-	if c.Get("Authorization") != "Bearer "+os.Getenv("WEBHOOK_BEARER") {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Unauthorized",
-		})
-	}
+// ErrSandboxEventIgnored is returned for sandbox events of users who are not
+// allowlisted testers, so TestFlight purchases never grant real credits.
+var ErrSandboxEventIgnored = errors.New("sandbox event for non-tester user")
 
-	// Get the JSON body from request
-	payload := new(model.WebhookPayload)
-	if err := c.BodyParser(payload); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": err.Error(),
-		})
-	}
+var errEventWithoutUser = errors.New("event without app user id")
 
-	event := payload.Event
+// ProcessEvent applies a RevenueCat event to the user's account.
+func ProcessEvent(event *model.Event) (*model.UserCredits, error) {
 	var response *model.UserCredits
 	var err error
 
+	// Sandbox events of other users must not link or merge any account either
+	if event.Type != "TEST" && event.Environment == config.EnvironmentSandbox {
+		tester, err := isSandboxTesterEvent(event)
+		if err != nil {
+			return nil, err
+		}
+		if !tester {
+			return nil, ErrSandboxEventIgnored
+		}
+	}
+
+	// Transfers move the subscription between users rather than link them
+	if event.Type != "TEST" && event.Type != "TRANSFER" {
+		if err := resolveEventUser(event); err != nil {
+			return nil, err
+		}
+	}
+
+	if event.Type != "TEST" && event.Type != "TRANSFER" && event.AppUserID == "" {
+		return nil, errEventWithoutUser
+	}
+
 	switch event.Type {
 	case "TEST":
-		handleTestEvent(&event)
+		handleTestEvent(event)
 
 	case "INITIAL_PURCHASE":
-		response, err = handleInitialPurchaseEvent(&event)
+		response, err = handleInitialPurchaseEvent(event)
 
 	case "RENEWAL":
-		response, err = handleRenewalEvent(&event)
+		response, err = handleRenewalEvent(event)
 
 	case "CANCELLATION":
-		response, err = handleCancelationEvent(&event)
+		response, err = handleCancelationEvent(event)
 
 	case "UNCANCELLATION":
-		break
+		response, err = handleSubscriptionStatusEvent(event)
 
 	case "NON_RENEWING_PURCHASE":
-		response, err = handleNonRenewingPurchase(&event)
+		response, err = handleNonRenewingPurchase(event)
 
 	case "SUBSCRIPTION_PAUSED":
-		break
+		response, err = handleSubscriptionStatusEvent(event)
 
 	case "EXPIRATION":
-		response, err = handleExpirationEvent(&event)
+		response, err = handleExpirationEvent(event)
 
 	case "BILLING_ISSUE":
-		break
+		response, err = handleSubscriptionStatusEvent(event)
 
 	case "PRODUCT_CHANGE":
-		break
+		response, err = handleSubscriptionStatusEvent(event)
+
+	case "TRANSFER":
+		response, err = handleTransferEvent(event)
+
+	case "SUBSCRIPTION_EXTENDED":
+		response, err = handleSubscriptionStatusEvent(event)
 
 	default:
 		break
 	}
 
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+	return response, err
+}
+
+// EventHook records a RevenueCat delivery, already authenticated by
+// middleware.WebhookAuth, and queues it.
+func EventHook(c *fiber.Ctx) error {
+	// Get the JSON body from request
+	payload := new(model.WebhookPayload)
+	if err := c.BodyParser(payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": err.Error(),
 		})
 	}
 
-	return c.Status(fiber.StatusOK).JSON(response)
+	event := payload.Event
+	if event.ID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Missing event id",
+		})
+	}
+
+	return acceptWebhookEvent(c, &event, c.Body())
+}
+
+func GetSubscriptionStatus(c *fiber.Ctx) error {
+	user := c.Locals("user").(gofiberfirebaseauth.User)
+
+	var sub model.Subscription
+	err := database.Pool.Where("user_id = ?", user.UserID).Limit(1).Find(&sub).Error
+	if err != nil {
+		log.Println("Database:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	status := model.SubscriptionStatus{Status: subscription.StatusNone}
+	if sub.Model == nil {
+		return c.Status(fiber.StatusOK).JSON(status)
+	}
+
+	entitled, until := subscription.Entitled(sub, time.Now().UnixMilli())
+	status = model.SubscriptionStatus{
+		Status:           sub.Status,
+		Store:            sub.Store,
+		ProductID:        sub.ProductID,
+		Plan:             planName(sub.Store, sub.ProductID),
+		PendingProductID: sub.PendingProductID,
+		Entitled:         entitled,
+		ExpiresAtMs:      sub.ExpirationAtMs,
+		EntitledUntilMs:  until,
+		AutoResumeAtMs:   sub.AutoResumeAtMs,
+	}
+
+	return c.Status(fiber.StatusOK).JSON(status)
 }
 
+// DisableEmails stops webhook handlers from emailing users, so replays do not
+// resend what users were already told.
+var DisableEmails bool
+
 func sendEmail(emailType string, recipient string, data model.EmailData) error {
+	if DisableEmails {
+		return nil
+	}
+
 	user, err := config.FirebaseAuth.GetUser(context.Background(), recipient)
 	if err != nil {
 		log.Println("[Err]", err)
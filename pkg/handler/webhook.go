@@ -0,0 +1,226 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/gofiber/fiber/v2"
+	"github.com/vndee/lensquery-backend/pkg/config"
+	"github.com/vndee/lensquery-backend/pkg/database"
+	"github.com/vndee/lensquery-backend/pkg/model"
+	"github.com/vndee/lensquery-backend/pkg/queue"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Webhook event statuses
+const (
+	WebhookEventReceived   = "RECEIVED"
+	WebhookEventProcessing = "PROCESSING"
+	WebhookEventProcessed  = "PROCESSED"
+	WebhookEventFailed     = "FAILED"
+	WebhookEventIgnored    = "IGNORED"
+)
+
+// recordWebhookEvent stores a delivery with its raw payload unless an event
+// with the same ID was received before, and reports whether it was new.
+func recordWebhookEvent(event *model.Event, payload []byte) (bool, error) {
+	return storeWebhookEvent(event, payload, WebhookEventReceived, "")
+}
+
+// recordIgnoredWebhookEvent stores a delivery that cannot be applied yet
+// without queueing it, so a replay can apply it later.
+func recordIgnoredWebhookEvent(event *model.Event, payload []byte, reason string) (bool, error) {
+	return storeWebhookEvent(event, payload, WebhookEventIgnored, reason)
+}
+
+func storeWebhookEvent(event *model.Event, payload []byte, status string, reason string) (bool, error) {
+	response := database.Pool.Clauses(clause.OnConflict{DoNothing: true}).Create(&model.WebhookEvent{
+		ID:            event.ID,
+		Type:          event.Type,
+		AppUserID:     event.AppUserID,
+		TransactionID: event.TransactionID,
+		Environment:   config.NormalizeEnvironment(event.Environment),
+		Store:         event.Store,
+		Price:         event.Price,
+		Payload:       string(payload),
+		Status:        status,
+		Error:         reason,
+	})
+
+	return response.RowsAffected > 0, response.Error
+}
+
+// claimWebhookEvent moves the event to PROCESSING if it is in one of the
+// given statuses, so only one delivery applies it at a time.
+func claimWebhookEvent(eventID string, statuses ...string) (bool, error) {
+	response := database.Pool.Model(&model.WebhookEvent{}).
+		Where("id = ? AND status IN ?", eventID, statuses).
+		Updates(map[string]interface{}{
+			"status":   WebhookEventProcessing,
+			"attempts": gorm.Expr("attempts + 1"),
+		})
+
+	return response.RowsAffected > 0, response.Error
+}
+
+// processWebhookEvent applies a claimed event and records the outcome.
+func processWebhookEvent(event *model.Event) (*model.UserCredits, error) {
+	response, err := ProcessEvent(event)
+
+	updates := map[string]interface{}{
+		"status":       WebhookEventProcessed,
+		"error":        "",
+		"processed_at": time.Now(),
+	}
+	if errors.Is(err, ErrSandboxEventIgnored) {
+		updates["status"] = WebhookEventIgnored
+		updates["error"] = err.Error()
+		err = nil
+	} else if err != nil {
+		log.Printf("Process webhook event %s: %v", event.ID, err)
+		updates = map[string]interface{}{
+			"status": WebhookEventFailed,
+			"error":  err.Error(),
+		}
+	}
+
+	if dbErr := database.Pool.Model(&model.WebhookEvent{}).Where("id = ?", event.ID).Updates(updates).Error; dbErr != nil {
+		log.Println("Database:", dbErr)
+	}
+
+	return response, err
+}
+
+// ReplayWebhookEvent records the event if it is new and applies it again
+// whatever its status, for backfills after a handler bug. Ledger postings are
+// keyed on their source, so credits already granted are not granted twice.
+func ReplayWebhookEvent(event *model.Event, payload []byte) (*model.UserCredits, error) {
+	_, err := recordWebhookEvent(event, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = claimWebhookEvent(event.ID, WebhookEventReceived, WebhookEventProcessing, WebhookEventProcessed, WebhookEventFailed, WebhookEventIgnored)
+	if err != nil {
+		return nil, err
+	}
+
+	return processWebhookEvent(event)
+}
+
+// ProcessQueuedWebhookEvent applies a stored event popped off the webhook
+// queue. Events already applied, or being applied, are skipped; an error
+// sends the event back to the queue for a retry.
+func ProcessQueuedWebhookEvent(eventID string) error {
+	var record model.WebhookEvent
+	response := database.Pool.Where("id = ?", eventID).First(&record)
+	if err := database.ProcessDatabaseResponse(response); err != nil {
+		return err
+	}
+
+	payload := model.WebhookPayload{}
+	if err := sonic.Unmarshal([]byte(record.Payload), &payload); err != nil {
+		return err
+	}
+
+	claimed, err := claimWebhookEvent(record.ID, WebhookEventReceived, WebhookEventFailed)
+	if err != nil || !claimed {
+		return err
+	}
+
+	_, err = processWebhookEvent(&payload.Event)
+	return err
+}
+
+// RequeueStuckWebhookEvents queues again the events left RECEIVED or
+// PROCESSING for longer than config.WebhookStuckTimeout, after a queueing
+// failure or a worker dying mid-event. Events stuck PROCESSING are marked
+// FAILED first so the worker can claim them again.
+func RequeueStuckWebhookEvents(ctx context.Context) (int, error) {
+	var ids []string
+	err := database.Pool.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&model.WebhookEvent{}).
+			Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status IN ? AND updated_at < ?", []string{WebhookEventReceived, WebhookEventProcessing}, time.Now().Add(-config.WebhookStuckTimeout)).
+			Pluck("id", &ids).Error
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+
+		// Touching updated_at keeps the next sweep off them until they time out again
+		return tx.Model(&model.WebhookEvent{}).Where("id IN ?", ids).Updates(map[string]interface{}{
+			"status": gorm.Expr("CASE WHEN status = ? THEN ? ELSE status END", WebhookEventProcessing, WebhookEventFailed),
+		}).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		if err := queue.Webhooks.Enqueue(ctx, id); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(ids), nil
+}
+
+// StartWebhookSweeper periodically requeues stuck webhook events.
+func StartWebhookSweeper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			requeued, err := RequeueStuckWebhookEvents(context.Background())
+			if err != nil {
+				log.Println("[Webhook] Requeue stuck events:", err)
+			} else if requeued > 0 {
+				log.Printf("[Webhook] Requeued %d stuck event(s)", requeued)
+			}
+		}
+	}()
+}
+
+// acceptWebhookEvent records a delivery and queues it for the worker, so the
+// sender is acknowledged without waiting for the event to be applied.
+func acceptWebhookEvent(c *fiber.Ctx, event *model.Event, payload []byte) error {
+	created, err := recordWebhookEvent(event, payload)
+	if err != nil {
+		log.Println("Database:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// A redelivery is only queued again if queueing it failed the first time;
+	// otherwise the queue already applied it or is retrying it
+	if !created {
+		var record model.WebhookEvent
+		err := database.Pool.Select("status").Where("id = ?", event.ID).First(&record).Error
+		if err != nil {
+			log.Println("Database:", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		if record.Status != WebhookEventReceived {
+			return c.Status(fiber.StatusOK).JSON(fiber.Map{
+				"duplicate": true,
+			})
+		}
+	}
+
+	// Fail the delivery so the sender tries again
+	if err := queue.Webhooks.Enqueue(c.Context(), event.ID); err != nil {
+		log.Println("Redis:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"queued": true,
+	})
+}
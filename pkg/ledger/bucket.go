@@ -0,0 +1,169 @@
+package ledger
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/vndee/lensquery-backend/pkg/database"
+	"github.com/vndee/lensquery-backend/pkg/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Bucket kinds
+const (
+	BucketTrial       = "trial"
+	BucketPurchased   = "purchased"
+	BucketPromotional = "promotional"
+)
+
+// fillBucketTx stores a credit in its own bucket. A negative balance is paid
+// off first, so only what is left over lands in the bucket.
+func fillBucketTx(tx *gorm.DB, userCredits *model.UserCredits, entry *model.LedgerEntry, p Posting) error {
+	kind := p.Bucket
+	if kind == "" {
+		kind = BucketPurchased
+	}
+
+	remaining := p.Amount
+	if userCredits.CreditAmount < 0 {
+		remaining += userCredits.CreditAmount
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	return tx.Create(&model.CreditBucket{
+		UserID:        p.UserID,
+		Kind:          kind,
+		Granted:       p.Amount,
+		Remaining:     remaining,
+		ExpiresAt:     p.ExpiresAt,
+		LedgerEntryID: entry.ID,
+	}).Error
+}
+
+// drainBucketsTx takes amount out of the user's live buckets, fromBucket
+// first when set, then soonest expiry first and never-expiring buckets last.
+// Whatever the buckets cannot cover is the overdraft carried by the balance.
+func drainBucketsTx(tx *gorm.DB, userID string, amount model.Credits, fromBucket uint) error {
+	var err error
+	if fromBucket > 0 {
+		amount, err = takeFromBucketsTx(tx, amount, tx.Where("user_id = ? AND id = ? AND remaining > 0", userID, fromBucket))
+		if err != nil || amount <= 0 {
+			return err
+		}
+	}
+
+	query := tx.Where("user_id = ? AND remaining > 0", userID).Where("expires_at IS NULL OR expires_at > ?", time.Now())
+	_, err = takeFromBucketsTx(tx, amount, query)
+	return err
+}
+
+// takeFromBucketsTx drains the buckets matched by query in order and returns
+// what they could not cover.
+func takeFromBucketsTx(tx *gorm.DB, amount model.Credits, query *gorm.DB) (model.Credits, error) {
+	var buckets []model.CreditBucket
+	err := query.Clauses(clause.Locking{Strength: "UPDATE"}).Order("expires_at ASC NULLS LAST").Order("id ASC").Find(&buckets).Error
+	if err != nil {
+		return amount, err
+	}
+
+	for _, bucket := range buckets {
+		if amount <= 0 {
+			break
+		}
+
+		taken := bucket.Remaining
+		if taken > amount {
+			taken = amount
+		}
+
+		err := tx.Model(&model.CreditBucket{}).Where("id = ?", bucket.ID).Update("remaining", bucket.Remaining-taken).Error
+		if err != nil {
+			return amount, err
+		}
+		amount -= taken
+	}
+
+	return amount, nil
+}
+
+// expireBucketsTx posts an expiry entry for every lapsed bucket of the user
+// whose credit row is locked by tx.
+func expireBucketsTx(tx *gorm.DB, userCredits *model.UserCredits) error {
+	var buckets []model.CreditBucket
+	err := tx.Where("user_id = ? AND remaining > 0 AND expires_at <= ?", userCredits.UserID, time.Now()).Order("id ASC").Find(&buckets).Error
+	if err != nil {
+		return err
+	}
+
+	for _, bucket := range buckets {
+		_, err := appendEntryTx(tx, userCredits, Posting{
+			UserID:         userCredits.UserID,
+			EntryType:      EntryExpiry,
+			Amount:         -bucket.Remaining,
+			Counterparty:   AccountExpired,
+			SourceType:     SourceBucket,
+			SourceID:       strconv.FormatUint(uint64(bucket.ID), 10),
+			Memo:           bucket.Kind,
+			AllowOverdraft: true,
+			FromBucket:     bucket.ID,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ExpireBuckets expires lapsed buckets of every user.
+func ExpireBuckets() (int, error) {
+	var userIDs []string
+	err := database.Pool.Model(&model.CreditBucket{}).
+		Where("remaining > 0 AND expires_at <= ?", time.Now()).
+		Distinct().Pluck("user_id", &userIDs).Error
+	if err != nil {
+		return 0, err
+	}
+
+	for _, userID := range userIDs {
+		err := database.Pool.Transaction(func(tx *gorm.DB) error {
+			userCredits, err := lockUserCredits(tx, userID)
+			if err != nil || userCredits == nil {
+				return err
+			}
+
+			return expireBucketsTx(tx, userCredits)
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(userIDs), nil
+}
+
+// PurchasedBalance sums what is left in the user's live purchased buckets.
+func PurchasedBalance(userID string) (model.Credits, error) {
+	var purchased model.Credits
+	err := database.Pool.Model(&model.CreditBucket{}).
+		Where("user_id = ? AND kind = ? AND remaining > 0", userID, BucketPurchased).
+		Where("expires_at IS NULL OR expires_at > ?", time.Now()).
+		Select("COALESCE(SUM(remaining), 0)::bigint").Scan(&purchased).Error
+
+	return purchased, err
+}
+
+// Buckets lists the user's live buckets in the order they are consumed.
+func Buckets(userID string) ([]model.CreditBucket, error) {
+	var buckets []model.CreditBucket
+	err := database.Pool.
+		Where("user_id = ? AND remaining > 0", userID).
+		Where("expires_at IS NULL OR expires_at > ?", time.Now()).
+		Order("expires_at ASC NULLS LAST").Order("id ASC").
+		Find(&buckets).Error
+
+	return buckets, err
+}
@@ -0,0 +1,63 @@
+package ledger
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/vndee/lensquery-backend/pkg/model"
+	"gorm.io/gorm"
+)
+
+// SpendingCap limits the snap and chat spending of a user since Since.
+type SpendingCap struct {
+	Name     string
+	Limit    model.Credits
+	Since    time.Time
+	ResetsAt time.Time
+}
+
+// SpendingCapError reports a reservation that would take the user past one
+// of their spending caps.
+type SpendingCapError struct {
+	Cap      string
+	Limit    model.Credits
+	Spent    model.Credits
+	ResetsAt time.Time
+}
+
+func (e *SpendingCapError) Error() string {
+	return fmt.Sprintf("%s spending cap exceeded", e.Cap)
+}
+
+// checkSpendingCapsTx returns a *SpendingCapError when amount on top of what
+// the user spent and holds would break one of caps. Active holds count as
+// spent, since they are charges in flight. The user's credit row must be
+// locked by tx so concurrent reservations are counted one at a time.
+func checkSpendingCapsTx(tx *gorm.DB, userID string, amount model.Credits, caps []SpendingCap) error {
+	if len(caps) == 0 {
+		return nil
+	}
+
+	held, err := HeldTx(tx, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, spendingCap := range caps {
+		spent, err := SpentTx(tx, userID, spendingCap.Since)
+		if err != nil {
+			return err
+		}
+
+		if spent+held+amount > spendingCap.Limit {
+			return &SpendingCapError{
+				Cap:      spendingCap.Name,
+				Limit:    spendingCap.Limit,
+				Spent:    spent + held,
+				ResetsAt: spendingCap.ResetsAt,
+			}
+		}
+	}
+
+	return nil
+}
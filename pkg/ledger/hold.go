@@ -0,0 +1,183 @@
+package ledger
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/vndee/lensquery-backend/pkg/database"
+	"github.com/vndee/lensquery-backend/pkg/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Hold statuses
+const (
+	HoldActive   = "ACTIVE"
+	HoldSettled  = "SETTLED"
+	HoldReleased = "RELEASED"
+)
+
+var ErrHoldClosed = errors.New("credit hold is no longer active")
+
+// AvailableTx returns the balance minus all unexpired active holds and any
+// lapsed buckets that have not been expired yet.
+func AvailableTx(tx *gorm.DB, userID string) (model.Credits, error) {
+	var userCredits model.UserCredits
+	response := tx.Where("user_id = ?", userID).Limit(1).Find(&userCredits)
+	if response.Error != nil {
+		return 0, response.Error
+	}
+
+	held, err := HeldTx(tx, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	var lapsed model.Credits
+	err = tx.Model(&model.CreditBucket{}).
+		Where("user_id = ? AND remaining > 0 AND expires_at <= ?", userID, time.Now()).
+		Select("COALESCE(SUM(remaining), 0)::bigint").Scan(&lapsed).Error
+	if err != nil {
+		return 0, err
+	}
+
+	return userCredits.CreditAmount - held - lapsed, nil
+}
+
+// HeldTx sums the user's active holds.
+func HeldTx(tx *gorm.DB, userID string) (model.Credits, error) {
+	var held model.Credits
+	err := tx.Model(&model.CreditHold{}).
+		Where("user_id = ? AND status = ? AND expires_at > ?", userID, HoldActive, time.Now()).
+		Select("COALESCE(SUM(amount), 0)::bigint").Scan(&held).Error
+
+	return held, err
+}
+
+func Available(userID string) (model.Credits, error) {
+	return AvailableTx(database.Pool, userID)
+}
+
+// Reserve places a hold of amount on the user's available balance, unless it
+// would break one of caps.
+func Reserve(userID string, amount model.Credits, ttl time.Duration, caps ...SpendingCap) (*model.CreditHold, error) {
+	var hold *model.CreditHold
+	err := database.Pool.Transaction(func(tx *gorm.DB) error {
+		// Lock the credit row so concurrent reservations see each other
+		userCredits, err := lockUserCredits(tx, userID)
+		if err != nil {
+			return err
+		}
+		if userCredits == nil {
+			return ErrInsufficientCredit
+		}
+
+		err = expireBucketsTx(tx, userCredits)
+		if err != nil {
+			return err
+		}
+
+		available, err := AvailableTx(tx, userID)
+		if err != nil {
+			return err
+		}
+		if available < amount {
+			return ErrInsufficientCredit
+		}
+
+		err = checkSpendingCapsTx(tx, userID, amount, caps)
+		if err != nil {
+			return err
+		}
+
+		hold = &model.CreditHold{
+			UserID:    userID,
+			Amount:    amount,
+			Status:    HoldActive,
+			ExpiresAt: time.Now().Add(ttl),
+		}
+		return tx.Create(hold).Error
+	})
+
+	return hold, err
+}
+
+// SettleTx closes the hold and posts the actual charge, which may differ from
+// the reserved amount. Settling an expired hold still bills the usage.
+func SettleTx(tx *gorm.DB, holdID uint, p Posting) (*model.LedgerEntry, error) {
+	var hold model.CreditHold
+	response := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&hold, holdID)
+	if err := database.ProcessDatabaseResponse(response); err != nil {
+		return nil, err
+	}
+	if hold.Status == HoldSettled {
+		return nil, ErrHoldClosed
+	}
+
+	p.AllowOverdraft = true
+	entry, err := PostTx(tx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	response = tx.Model(&model.CreditHold{}).Where("id = ?", holdID).Updates(map[string]interface{}{
+		"status": HoldSettled,
+		"reason": "",
+	})
+	return entry, database.ProcessDatabaseResponse(response)
+}
+
+func Settle(holdID uint, p Posting) (*model.LedgerEntry, error) {
+	var entry *model.LedgerEntry
+	err := database.Pool.Transaction(func(tx *gorm.DB) error {
+		var err error
+		entry, err = SettleTx(tx, holdID, p)
+		return err
+	})
+
+	return entry, err
+}
+
+// Release frees the hold without charging.
+func Release(holdID uint, reason string) error {
+	response := database.Pool.Model(&model.CreditHold{}).Where("id = ? AND status = ?", holdID, HoldActive).Updates(map[string]interface{}{
+		"status": HoldReleased,
+		"reason": reason,
+	})
+	return response.Error
+}
+
+// ReleaseExpiredHolds releases every active hold past its expiry.
+func ReleaseExpiredHolds() (int64, error) {
+	response := database.Pool.Model(&model.CreditHold{}).Where("status = ? AND expires_at <= ?", HoldActive, time.Now()).Updates(map[string]interface{}{
+		"status": HoldReleased,
+		"reason": "expired",
+	})
+	return response.RowsAffected, response.Error
+}
+
+// StartSweeper periodically releases holds that were never settled and
+// expires lapsed credit buckets.
+func StartSweeper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			released, err := ReleaseExpiredHolds()
+			if err != nil {
+				log.Println("[Ledger] Release expired holds:", err)
+			} else if released > 0 {
+				log.Printf("[Ledger] Released %d expired hold(s)", released)
+			}
+
+			expired, err := ExpireBuckets()
+			if err != nil {
+				log.Println("[Ledger] Expire buckets:", err)
+			} else if expired > 0 {
+				log.Printf("[Ledger] Expired buckets of %d user(s)", expired)
+			}
+		}
+	}()
+}
@@ -0,0 +1,261 @@
+package ledger
+
+import (
+	"errors"
+	"time"
+
+	"github.com/vndee/lensquery-backend/pkg/config"
+	"github.com/vndee/lensquery-backend/pkg/database"
+	"github.com/vndee/lensquery-backend/pkg/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Entry types
+const (
+	EntryPurchase         = "PURCHASE"
+	EntryTrial            = "TRIAL"
+	EntrySnap             = "SNAP"
+	EntryChat             = "CHAT"
+	EntryChatCorrection   = "CHAT_CORRECTION"
+	EntryExpiry           = "EXPIRY"
+	EntryPromo            = "PROMO"
+	EntryReferral         = "REFERRAL"
+	EntryAdjustment       = "ADJUSTMENT"
+	EntryAdjustmentRevert = "ADJUSTMENT_REVERT"
+	EntryRefund           = "REFUND"
+	EntryAliasMergeOut    = "ALIAS_MERGE_OUT"
+	EntryAliasMergeIn     = "ALIAS_MERGE_IN"
+
+	// EntryOpeningBalance carries a balance that predates the ledger. These
+	// entries are posted by the database migration, not through PostTx.
+	EntryOpeningBalance = "OPENING_BALANCE"
+)
+
+// Sources an entry can be linked to
+const (
+	SourceWebhookEvent     = "WEBHOOK_EVENT"
+	SourceOCRRequest       = "OCR_REQUEST"
+	SourceGeneration       = "GENERATION"
+	SourceTrial            = "TRIAL"
+	SourceBucket           = "BUCKET"
+	SourcePromoRedemption  = "PROMO_REDEMPTION"
+	SourceReferral         = "REFERRAL"
+	SourceAdjustment       = "ADJUSTMENT"
+	SourceStoreTransaction = "STORE_TRANSACTION"
+	SourceAccountAlias     = "ACCOUNT_ALIAS"
+	SourceUserCredits      = "USER_CREDITS"
+)
+
+// System accounts on the other side of a user posting
+const (
+	AccountTrial      = "system:trial"
+	AccountRevenue    = "system:revenue"
+	AccountExpired    = "system:expired"
+	AccountPromotions = "system:promotions"
+	AccountOpening    = "system:opening"
+)
+
+var (
+	ErrInsufficientCredit = errors.New("insufficient credit")
+	ErrDuplicateEntry     = errors.New("duplicate ledger entry")
+	ErrMissingSource      = errors.New("ledger entry without a source")
+)
+
+// Posting describes a balance change for a single user. Amount is signed:
+// positive values credit the user into a new bucket of kind Bucket (purchased
+// when empty) expiring at ExpiresAt, negative values debit them from
+// FromBucket first when set, then from the soonest-expiring buckets. Postings
+// caused by sandbox store events carry Environment SANDBOX.
+type Posting struct {
+	UserID         string
+	EntryType      string
+	Amount         model.Credits
+	Counterparty   string
+	SourceType     string
+	SourceID       string
+	Memo           string
+	AllowOverdraft bool
+	Bucket         string
+	ExpiresAt      *time.Time
+	FromBucket     uint
+	Environment    string
+
+	// keepBuckets posts the entry without touching buckets, for merges that
+	// move the buckets themselves.
+	keepBuckets bool
+}
+
+func UserAccount(userID string) string {
+	return "user:" + userID
+}
+
+func StoreAccount(store string) string {
+	return "store:" + store
+}
+
+func AdminAccount(actorUID string) string {
+	return "admin:" + actorUID
+}
+
+// Post applies the posting in its own transaction.
+func Post(p Posting) (*model.LedgerEntry, error) {
+	var entry *model.LedgerEntry
+	err := database.Pool.Transaction(func(tx *gorm.DB) error {
+		var err error
+		entry, err = PostTx(tx, p)
+		return err
+	})
+
+	return entry, err
+}
+
+// PostTx locks the user's credit row, appends the ledger entry and updates the
+// cached balance inside tx, so concurrent postings for one user are serialized.
+// Every posting needs a SourceID, which is what makes it idempotent.
+func PostTx(tx *gorm.DB, p Posting) (*model.LedgerEntry, error) {
+	if p.SourceID == "" {
+		return nil, ErrMissingSource
+	}
+
+	userCredits, err := lockUserCredits(tx, p.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if userCredits == nil {
+		if p.Amount < 0 && !p.AllowOverdraft {
+			return nil, ErrInsufficientCredit
+		}
+
+		userCredits = &model.UserCredits{UserID: p.UserID}
+		if err := tx.Create(userCredits).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	err = expireBucketsTx(tx, userCredits)
+	if err != nil {
+		return nil, err
+	}
+
+	return appendEntryTx(tx, userCredits, p)
+}
+
+func lockUserCredits(tx *gorm.DB, userID string) (*model.UserCredits, error) {
+	var userCredits model.UserCredits
+	response := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ?", userID).Limit(1).Find(&userCredits)
+	if response.Error != nil {
+		return nil, response.Error
+	}
+	if response.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	return &userCredits, nil
+}
+
+// appendEntryTx writes the entry, moves credits in or out of buckets and
+// updates userCredits, whose row must already be locked by tx.
+func appendEntryTx(tx *gorm.DB, userCredits *model.UserCredits, p Posting) (*model.LedgerEntry, error) {
+	balance := userCredits.CreditAmount + p.Amount
+	if p.Amount < 0 && balance < 0 && !p.AllowOverdraft {
+		return nil, ErrInsufficientCredit
+	}
+
+	var duplicates int64
+	err := tx.Model(&model.LedgerEntry{}).
+		Where("entry_type = ? AND source_type = ? AND source_id = ?", p.EntryType, p.SourceType, p.SourceID).
+		Count(&duplicates).Error
+	if err != nil {
+		return nil, err
+	}
+	if duplicates > 0 {
+		return nil, ErrDuplicateEntry
+	}
+
+	entry := model.LedgerEntry{
+		UserID:       p.UserID,
+		EntryType:    p.EntryType,
+		BalanceAfter: balance,
+		SourceType:   p.SourceType,
+		SourceID:     p.SourceID,
+		Memo:         p.Memo,
+		Environment:  config.NormalizeEnvironment(p.Environment),
+	}
+	if p.Amount >= 0 {
+		entry.DebitAccount = p.Counterparty
+		entry.CreditAccount = UserAccount(p.UserID)
+		entry.Amount = p.Amount
+	} else {
+		entry.DebitAccount = UserAccount(p.UserID)
+		entry.CreditAccount = p.Counterparty
+		entry.Amount = -p.Amount
+	}
+
+	if err := tx.Create(&entry).Error; err != nil {
+		return nil, err
+	}
+
+	switch {
+	case p.keepBuckets:
+	case p.Amount >= 0:
+		err = fillBucketTx(tx, userCredits, &entry, p)
+	default:
+		err = drainBucketsTx(tx, p.UserID, -p.Amount, p.FromBucket)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	response := tx.Model(&model.UserCredits{}).Where("user_id = ?", p.UserID).Update("credit_amount", balance)
+	if err := database.ProcessDatabaseResponse(response); err != nil {
+		return nil, err
+	}
+	userCredits.CreditAmount = balance
+
+	return &entry, nil
+}
+
+// Balance derives the user's balance from the ledger alone.
+func Balance(userID string) (model.Credits, error) {
+	var credited, debited model.Credits
+	account := UserAccount(userID)
+
+	err := database.Pool.Model(&model.LedgerEntry{}).Where("credit_account = ?", account).Select("COALESCE(SUM(amount), 0)::bigint").Scan(&credited).Error
+	if err != nil {
+		return 0, err
+	}
+
+	err = database.Pool.Model(&model.LedgerEntry{}).Where("debit_account = ?", account).Select("COALESCE(SUM(amount), 0)::bigint").Scan(&debited).Error
+	if err != nil {
+		return 0, err
+	}
+
+	return credited - debited, nil
+}
+
+// Spent sums the user's snap and chat charges, including corrections, posted
+// since the given time.
+func SpentTx(tx *gorm.DB, userID string, since time.Time) (model.Credits, error) {
+	var spent model.Credits
+	err := tx.Model(&model.LedgerEntry{}).
+		Where("debit_account = ? AND entry_type IN ? AND created_at >= ?", UserAccount(userID), []string{EntrySnap, EntryChat, EntryChatCorrection}, since).
+		Select("COALESCE(SUM(amount), 0)::bigint").Scan(&spent).Error
+	if err != nil {
+		return 0, err
+	}
+
+	return spent, nil
+}
+
+// CountEntries counts the user's entries of entryType with the given memo
+// posted since the given time.
+func CountEntries(userID string, entryType string, memo string, since time.Time) (int64, error) {
+	var count int64
+	err := database.Pool.Model(&model.LedgerEntry{}).
+		Where("user_id = ? AND entry_type = ? AND memo = ? AND created_at >= ?", userID, entryType, memo, since).
+		Count(&count).Error
+
+	return count, err
+}
@@ -0,0 +1,299 @@
+package ledger
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vndee/lensquery-backend/pkg/database"
+	"github.com/vndee/lensquery-backend/pkg/model"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// setupDB points database.Pool at the Postgres database of TEST_DATABASE_URL
+// and returns a user ID no other test run has used. Tests are skipped when
+// the variable is not set.
+func setupDB(t *testing.T) string {
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	if database.Pool == nil {
+		pool, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+		require.NoError(t, err)
+
+		err = pool.AutoMigrate(&model.UserCredits{}, &model.LedgerEntry{}, &model.CreditHold{}, &model.CreditBucket{})
+		require.NoError(t, err)
+
+		database.Pool = pool
+	}
+
+	return fmt.Sprintf("test:%s:%d", t.Name(), time.Now().UnixNano())
+}
+
+func grant(t *testing.T, userID string, sourceID string, amount float64) *model.LedgerEntry {
+	return grantBucket(t, userID, sourceID, amount, "", nil)
+}
+
+func grantBucket(t *testing.T, userID string, sourceID string, amount float64, bucket string, expiresAt *time.Time) *model.LedgerEntry {
+	entry, err := Post(Posting{
+		UserID:       userID,
+		EntryType:    EntryPurchase,
+		Amount:       model.NewCredits(amount),
+		Counterparty: StoreAccount("APP_STORE"),
+		SourceType:   SourceWebhookEvent,
+		SourceID:     userID + ":" + sourceID,
+		Bucket:       bucket,
+		ExpiresAt:    expiresAt,
+	})
+	require.NoError(t, err)
+
+	return entry
+}
+
+func charge(userID string, sourceID string, amount float64) Posting {
+	return Posting{
+		UserID:       userID,
+		EntryType:    EntryChat,
+		Amount:       -model.NewCredits(amount),
+		Counterparty: AccountRevenue,
+		SourceType:   SourceGeneration,
+		SourceID:     userID + ":" + sourceID,
+	}
+}
+
+func cachedBalance(t *testing.T, userID string) model.Credits {
+	var userCredits model.UserCredits
+	require.NoError(t, database.Pool.Where("user_id = ?", userID).First(&userCredits).Error)
+
+	return userCredits.CreditAmount
+}
+
+func TestPostTxRejectsDuplicates(t *testing.T) {
+	userID := setupDB(t)
+
+	grant(t, userID, "a", 10)
+
+	_, err := Post(Posting{
+		UserID:       userID,
+		EntryType:    EntryPurchase,
+		Amount:       model.NewCredits(10),
+		Counterparty: StoreAccount("APP_STORE"),
+		SourceType:   SourceWebhookEvent,
+		SourceID:     userID + ":a",
+	})
+	assert.ErrorIs(t, err, ErrDuplicateEntry)
+
+	// The same source may still back an entry of another type
+	_, err = Post(Posting{
+		UserID:       userID,
+		EntryType:    EntryChat,
+		Amount:       -model.NewCredits(4),
+		Counterparty: AccountRevenue,
+		SourceType:   SourceWebhookEvent,
+		SourceID:     userID + ":a",
+	})
+	assert.NoError(t, err)
+
+	// An empty source would make every such posting a duplicate of the first
+	missing := charge(userID, "", 1)
+	missing.SourceID = ""
+	_, err = Post(missing)
+	assert.ErrorIs(t, err, ErrMissingSource)
+
+	balance, err := Balance(userID)
+	assert.NoError(t, err)
+	assert.Equal(t, model.NewCredits(6), balance)
+	assert.Equal(t, model.NewCredits(6), cachedBalance(t, userID))
+}
+
+func TestPostTxInsufficientCredit(t *testing.T) {
+	userID := setupDB(t)
+
+	_, err := Post(charge(userID, "before-credit", 1))
+	assert.ErrorIs(t, err, ErrInsufficientCredit)
+
+	grant(t, userID, "a", 5)
+
+	_, err = Post(charge(userID, "too-much", 6))
+	assert.ErrorIs(t, err, ErrInsufficientCredit)
+
+	overdraft := charge(userID, "overdraft", 6)
+	overdraft.AllowOverdraft = true
+	entry, err := Post(overdraft)
+	assert.NoError(t, err)
+	assert.Equal(t, -model.NewCredits(1), entry.BalanceAfter)
+}
+
+func TestBucketsDrainSoonestExpiryFirst(t *testing.T) {
+	userID := setupDB(t)
+	soon := time.Now().Add(time.Hour)
+	later := time.Now().Add(2 * time.Hour)
+
+	purchased := grantBucket(t, userID, "purchased", 10, BucketPurchased, nil)
+	laterGrant := grantBucket(t, userID, "later", 5, BucketPromotional, &later)
+	soonGrant := grantBucket(t, userID, "soon", 5, BucketPromotional, &soon)
+
+	_, err := Post(charge(userID, "a", 7))
+	require.NoError(t, err)
+
+	buckets, err := Buckets(userID)
+	require.NoError(t, err)
+	require.Len(t, buckets, 2)
+
+	// The bucket expiring soonest is emptied, the never-expiring one is kept for last
+	assert.Equal(t, laterGrant.ID, buckets[0].LedgerEntryID)
+	assert.Equal(t, model.NewCredits(3), buckets[0].Remaining)
+	assert.Equal(t, purchased.ID, buckets[1].LedgerEntryID)
+	assert.Equal(t, model.NewCredits(10), buckets[1].Remaining)
+
+	var drained model.CreditBucket
+	require.NoError(t, database.Pool.Where("ledger_entry_id = ?", soonGrant.ID).First(&drained).Error)
+	assert.Equal(t, model.Credits(0), drained.Remaining)
+
+	// FromBucket is drained regardless of the expiry order
+	fromBucket := charge(userID, "b", 4)
+	fromBucket.FromBucket = buckets[1].ID
+	_, err = Post(fromBucket)
+	require.NoError(t, err)
+
+	buckets, err = Buckets(userID)
+	require.NoError(t, err)
+	assert.Equal(t, model.NewCredits(3), buckets[0].Remaining)
+	assert.Equal(t, model.NewCredits(6), buckets[1].Remaining)
+}
+
+func TestLapsedBucketsExpire(t *testing.T) {
+	userID := setupDB(t)
+	lapsed := time.Now().Add(-time.Minute)
+
+	grantBucket(t, userID, "kept", 10, BucketPurchased, nil)
+	grantBucket(t, userID, "lapsed", 4, BucketPromotional, &lapsed)
+
+	_, err := ExpireBuckets()
+	require.NoError(t, err)
+
+	assert.Equal(t, model.NewCredits(10), cachedBalance(t, userID))
+
+	var expiries int64
+	err = database.Pool.Model(&model.LedgerEntry{}).Where("user_id = ? AND entry_type = ?", userID, EntryExpiry).Count(&expiries).Error
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), expiries)
+
+	balance, err := Balance(userID)
+	assert.NoError(t, err)
+	assert.Equal(t, model.NewCredits(10), balance)
+}
+
+func TestAvailableTx(t *testing.T) {
+	userID := setupDB(t)
+	lapsed := time.Now().Add(-time.Minute)
+
+	available, err := AvailableTx(database.Pool, userID)
+	assert.NoError(t, err)
+	assert.Equal(t, model.Credits(0), available)
+
+	grant(t, userID, "a", 10)
+
+	_, err = Reserve(userID, model.NewCredits(3), time.Minute)
+	require.NoError(t, err)
+
+	// An expired hold no longer counts, even before it is swept
+	expired, err := Reserve(userID, model.NewCredits(2), time.Minute)
+	require.NoError(t, err)
+	err = database.Pool.Model(&model.CreditHold{}).Where("id = ?", expired.ID).Update("expires_at", lapsed).Error
+	require.NoError(t, err)
+
+	// Neither does a lapsed bucket the sweeper has not expired yet
+	grantBucket(t, userID, "lapsed", 4, BucketPurchased, &lapsed)
+	assert.Equal(t, model.NewCredits(14), cachedBalance(t, userID))
+
+	available, err = AvailableTx(database.Pool, userID)
+	assert.NoError(t, err)
+	assert.Equal(t, model.NewCredits(7), available)
+}
+
+func TestHoldLifecycle(t *testing.T) {
+	userID := setupDB(t)
+
+	_, err := Reserve(userID, model.NewCredits(1), time.Minute)
+	assert.ErrorIs(t, err, ErrInsufficientCredit)
+
+	grant(t, userID, "a", 10)
+
+	hold, err := Reserve(userID, model.NewCredits(6), time.Minute)
+	require.NoError(t, err)
+
+	_, err = Reserve(userID, model.NewCredits(5), time.Minute)
+	assert.ErrorIs(t, err, ErrInsufficientCredit)
+
+	// Settling bills the actual charge and frees the rest of the hold
+	entry, err := Settle(hold.ID, charge(userID, "a", 2))
+	require.NoError(t, err)
+	assert.Equal(t, model.NewCredits(8), entry.BalanceAfter)
+
+	available, err := Available(userID)
+	assert.NoError(t, err)
+	assert.Equal(t, model.NewCredits(8), available)
+
+	_, err = Settle(hold.ID, charge(userID, "again", 2))
+	assert.ErrorIs(t, err, ErrHoldClosed)
+
+	// A released hold frees its amount, and still bills when settled late
+	released, err := Reserve(userID, model.NewCredits(5), time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, Release(released.ID, "stream failed"))
+
+	available, err = Available(userID)
+	assert.NoError(t, err)
+	assert.Equal(t, model.NewCredits(8), available)
+
+	entry, err = Settle(released.ID, charge(userID, "late", 3))
+	require.NoError(t, err)
+	assert.Equal(t, model.NewCredits(5), entry.BalanceAfter)
+
+	var settled model.CreditHold
+	require.NoError(t, database.Pool.First(&settled, released.ID).Error)
+	assert.Equal(t, HoldSettled, settled.Status)
+
+	// An overcharge beyond the hold may overdraw the balance
+	overcharged, err := Reserve(userID, model.NewCredits(5), time.Minute)
+	require.NoError(t, err)
+	entry, err = Settle(overcharged.ID, charge(userID, "over", 7))
+	require.NoError(t, err)
+	assert.Equal(t, -model.NewCredits(2), entry.BalanceAfter)
+}
+
+func TestReserveSpendingCap(t *testing.T) {
+	userID := setupDB(t)
+	daily := SpendingCap{
+		Name:     "daily",
+		Limit:    model.NewCredits(5),
+		Since:    time.Now().Add(-time.Hour),
+		ResetsAt: time.Now().Add(time.Hour),
+	}
+
+	grant(t, userID, "a", 20)
+
+	_, err := Post(charge(userID, "spent", 2))
+	require.NoError(t, err)
+
+	_, err = Reserve(userID, model.NewCredits(2), time.Minute, daily)
+	require.NoError(t, err)
+
+	// Spent and held credits both count against the cap
+	_, err = Reserve(userID, model.NewCredits(2), time.Minute, daily)
+	var capErr *SpendingCapError
+	require.ErrorAs(t, err, &capErr)
+	assert.Equal(t, "daily", capErr.Cap)
+	assert.Equal(t, model.NewCredits(4), capErr.Spent)
+
+	_, err = Reserve(userID, model.NewCredits(1), time.Minute, daily)
+	assert.NoError(t, err)
+}
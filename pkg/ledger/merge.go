@@ -0,0 +1,97 @@
+package ledger
+
+import (
+	"github.com/vndee/lensquery-backend/pkg/model"
+	"gorm.io/gorm"
+)
+
+// MergeTx moves the whole balance of fromUserID, with its live buckets and
+// active holds, to toUserID. The move is posted as a pair of entries so both ledgers still add
+// up to their balances. It returns the amount moved.
+func MergeTx(tx *gorm.DB, fromUserID string, toUserID string) (model.Credits, error) {
+	// Lock in a fixed order so concurrent merges cannot deadlock
+	first, second := fromUserID, toUserID
+	if second < first {
+		first, second = second, first
+	}
+
+	locked := map[string]*model.UserCredits{}
+	for _, userID := range []string{first, second} {
+		userCredits, err := lockUserCredits(tx, userID)
+		if err != nil {
+			return 0, err
+		}
+		locked[userID] = userCredits
+	}
+
+	// Holds in flight are settled against the account the credits now live in
+	err := tx.Model(&model.CreditHold{}).Where("user_id = ? AND status = ?", fromUserID, HoldActive).Update("user_id", toUserID).Error
+	if err != nil {
+		return 0, err
+	}
+
+	from, to := locked[fromUserID], locked[toUserID]
+	if from == nil {
+		return 0, nil
+	}
+
+	if to == nil {
+		to = &model.UserCredits{UserID: toUserID}
+		if err := tx.Create(to).Error; err != nil {
+			return 0, err
+		}
+	}
+
+	if err := expireBucketsTx(tx, from); err != nil {
+		return 0, err
+	}
+
+	err = tx.Model(&model.CreditBucket{}).Where("user_id = ? AND remaining > 0", fromUserID).Update("user_id", toUserID).Error
+	if err != nil {
+		return 0, err
+	}
+
+	if from.PurchasedTimestampMs > to.PurchasedTimestampMs {
+		err := tx.Model(&model.UserCredits{}).Where("user_id = ?", toUserID).Update("purchased_timestamp_ms", from.PurchasedTimestampMs).Error
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	amount := from.CreditAmount
+	if amount == 0 {
+		return 0, nil
+	}
+
+	_, err = appendEntryTx(tx, from, Posting{
+		UserID:         fromUserID,
+		EntryType:      EntryAliasMergeOut,
+		Amount:         -amount,
+		Counterparty:   UserAccount(toUserID),
+		SourceType:     SourceAccountAlias,
+		SourceID:       fromUserID,
+		Memo:           toUserID,
+		AllowOverdraft: true,
+		keepBuckets:    true,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = appendEntryTx(tx, to, Posting{
+		UserID:         toUserID,
+		EntryType:      EntryAliasMergeIn,
+		Amount:         amount,
+		Counterparty:   UserAccount(fromUserID),
+		SourceType:     SourceAccountAlias,
+		SourceID:       fromUserID,
+		Memo:           fromUserID,
+		AllowOverdraft: true,
+		keepBuckets:    true,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return amount, nil
+}
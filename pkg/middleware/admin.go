@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/vndee/lensquery-backend/pkg/config"
+)
+
+// RequireAdmin only lets through users carrying the admin custom claim. The
+// claim is read from the ID token once Firebase has verified its signature.
+func RequireAdmin() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		idToken := strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+
+		token, err := config.FirebaseAuth.VerifyIDToken(context.Background(), idToken)
+		if err != nil {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Forbidden",
+			})
+		}
+
+		if isAdmin, _ := token.Claims[config.AdminClaim].(bool); !isAdmin {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Forbidden",
+			})
+		}
+
+		return c.Next()
+	}
+}
@@ -0,0 +1,154 @@
+package middleware
+
+import (
+	"log"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/gofiber/fiber/v2"
+	gofiberfirebaseauth "github.com/sacsand/gofiber-firebaseauth"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/vndee/lensquery-backend/pkg/config"
+	"github.com/vndee/lensquery-backend/pkg/database"
+	"github.com/vndee/lensquery-backend/pkg/ledger"
+	"github.com/vndee/lensquery-backend/pkg/model"
+	"github.com/vndee/lensquery-backend/pkg/subscription"
+)
+
+// Plan features reported in upgrade-required errors
+const (
+	FeatureCustomLLMProvider  = "custom_llm_provider"
+	FeatureFullChatExperience = "full_chat_experience"
+	FeatureTextOCRSnap        = "text_ocr_snap"
+	FeatureEquationOCRSnap    = "equation_ocr_snap"
+)
+
+const PlanLocal = "plan"
+
+// RequireChatEntitlement rejects conversations and models beyond the user's
+// plan. Without the full chat experience only single-turn chats are allowed,
+// and without a custom LLM provider only the default model.
+func RequireChatEntitlement() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		plan, err := resolvePlan(c)
+		if err != nil {
+			log.Println("Resolve plan:", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		var request openai.ChatCompletionRequest
+		if err := sonic.Unmarshal(c.Body(), &request); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		if !plan.CustomLLMProvider && request.Model != "" && request.Model != config.DefaultChatModel {
+			return upgradeRequired(c, plan, FeatureCustomLLMProvider, fiber.Map{
+				"allowed_models": []string{config.DefaultChatModel},
+			})
+		}
+
+		if !plan.FullChatExperience {
+			var userMessages int
+			for _, message := range request.Messages {
+				if message.Role == openai.ChatMessageRoleUser {
+					userMessages++
+				}
+			}
+
+			if userMessages > config.BasicChatMaxMessages {
+				return upgradeRequired(c, plan, FeatureFullChatExperience, fiber.Map{
+					"max_messages": config.BasicChatMaxMessages,
+				})
+			}
+		}
+
+		return c.Next()
+	}
+}
+
+// RequireSnapQuota enforces the plan's monthly quota of snaps of snapType,
+// counted per UTC calendar month.
+func RequireSnapQuota(snapType string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		plan, err := resolvePlan(c)
+		if err != nil {
+			log.Println("Resolve plan:", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		if plan.PayPerUse {
+			return c.Next()
+		}
+
+		quota, feature := plan.TextOCRSnap, FeatureTextOCRSnap
+		if snapType == "equation" {
+			quota, feature = plan.EquationOCRSnap, FeatureEquationOCRSnap
+		}
+
+		now := time.Now().UTC()
+		monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+		user := c.Locals("user").(gofiberfirebaseauth.User)
+		used, err := ledger.CountEntries(user.UserID, ledger.EntrySnap, snapType, monthStart)
+		if err != nil {
+			log.Println("Database:", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		if used >= int64(quota) {
+			return upgradeRequired(c, plan, feature, fiber.Map{
+				"limit":     quota,
+				"used":      used,
+				"resets_at": monthStart.AddDate(0, 1, 0),
+			})
+		}
+
+		return c.Next()
+	}
+}
+
+// resolvePlan returns the plan of the user's active subscription, the credit
+// pack plan when they hold purchased credits, or else the free plan, and keeps
+// it in the request locals.
+func resolvePlan(c *fiber.Ctx) (config.Plan, error) {
+	if plan, ok := c.Locals(PlanLocal).(config.Plan); ok {
+		return plan, nil
+	}
+
+	user := c.Locals("user").(gofiberfirebaseauth.User)
+
+	var sub model.Subscription
+	err := database.Pool.Where("user_id = ?", user.UserID).Limit(1).Find(&sub).Error
+	if err != nil {
+		return config.Plan{}, err
+	}
+
+	plan, subscribed := subscription.ActivePlan(sub, time.Now().UnixMilli(), config.GetPlan)
+	if !subscribed {
+		purchased, err := ledger.PurchasedBalance(user.UserID)
+		if err != nil {
+			return config.Plan{}, err
+		}
+		if purchased > 0 {
+			plan = config.CreditPackPlan
+		}
+	}
+	c.Locals(PlanLocal, plan)
+
+	return plan, nil
+}
+
+func upgradeRequired(c *fiber.Ctx, plan config.Plan, feature string, details fiber.Map) error {
+	body := fiber.Map{
+		"error":   "upgrade_required",
+		"feature": feature,
+		"plan":    plan.Name,
+	}
+	for key, value := range details {
+		body[key] = value
+	}
+
+	return c.Status(fiber.StatusForbidden).JSON(body)
+}
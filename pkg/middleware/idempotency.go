@@ -0,0 +1,170 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+
+	"github.com/bytedance/sonic"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	gofiberfirebaseauth "github.com/sacsand/gofiber-firebaseauth"
+	"github.com/vndee/lensquery-backend/pkg/config"
+	"github.com/vndee/lensquery-backend/pkg/database"
+)
+
+const (
+	IdempotencyKeyHeader      = "Idempotency-Key"
+	IdempotencyReplayedHeader = "Idempotent-Replayed"
+	IdempotencyKeyLocal       = "idempotency_key"
+)
+
+const (
+	idempotencyProcessing = "PROCESSING"
+	idempotencyCompleted  = "COMPLETED"
+)
+
+type idempotentResponse struct {
+	Status      string `json:"status"`
+	BodyHash    string `json:"body_hash"`
+	StatusCode  int    `json:"status_code"`
+	ContentType string `json:"content_type"`
+	Body        []byte `json:"body"`
+}
+
+// Idempotency replays the stored response when a request is retried with the
+// same Idempotency-Key, so the handler (and its billing) runs only once.
+// Keys are scoped per user and route, and bound to the request body: reusing
+// a key with another body is refused with 422. Only 2xx responses are stored;
+// any other outcome frees the key for another attempt.
+//
+// Handlers that stream their body must call SaveIdempotentResponse or
+// ReleaseIdempotencyKey themselves once the stream ends.
+func Idempotency() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key := c.Get(IdempotencyKeyHeader)
+		if key == "" {
+			return c.Next()
+		}
+
+		if len(key) > config.IdempotencyKeyMaxSize {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Idempotency-Key is too long",
+			})
+		}
+
+		user := c.Locals("user").(gofiberfirebaseauth.User)
+		redisKey := fmt.Sprintf("IDEMPOTENCY_%s_%s_%s", user.UserID, c.Path(), key)
+
+		sum := sha256.Sum256(c.Body())
+		bodyHash := hex.EncodeToString(sum[:])
+
+		lock, err := sonic.Marshal(&idempotentResponse{Status: idempotencyProcessing, BodyHash: bodyHash})
+		if err != nil {
+			log.Println("Marshal:", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		set, err := database.RedisClient.SetNX(c.Context(), redisKey, lock, config.IdempotencyLockTTL).Result()
+		if err != nil {
+			log.Println("Redis:", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		if !set {
+			return replayIdempotentResponse(c, redisKey, bodyHash)
+		}
+
+		c.Locals(IdempotencyKeyLocal, redisKey)
+
+		err = c.Next()
+
+		if c.Context().IsBodyStream() {
+			return err
+		}
+
+		statusCode := c.Response().StatusCode()
+		if err != nil || statusCode < fiber.StatusOK || statusCode >= fiber.StatusMultipleChoices {
+			ReleaseIdempotencyKey(redisKey)
+			return err
+		}
+
+		SaveIdempotentResponse(redisKey, statusCode, string(c.Response().Header.ContentType()), utils.CopyBytes(c.Response().Body()))
+		return nil
+	}
+}
+
+func replayIdempotentResponse(c *fiber.Ctx, redisKey string, bodyHash string) error {
+	data, err := database.RedisClient.Get(c.Context(), redisKey).Bytes()
+	if err != nil {
+		log.Println("Redis:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	var stored idempotentResponse
+	err = sonic.Unmarshal(data, &stored)
+	if err != nil {
+		log.Println("Unmarshal:", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	if stored.BodyHash != bodyHash {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Idempotency-Key was already used with a different request body",
+		})
+	}
+
+	if stored.Status != idempotencyCompleted {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "A request with this Idempotency-Key is still in progress",
+		})
+	}
+
+	c.Set(IdempotencyReplayedHeader, "true")
+	c.Set(fiber.HeaderContentType, stored.ContentType)
+	return c.Status(stored.StatusCode).Send(stored.Body)
+}
+
+// SaveIdempotentResponse stores the final response for an idempotency key
+// taken from the IdempotencyKeyLocal of the request, keeping the body hash
+// stored with its lock.
+func SaveIdempotentResponse(redisKey string, statusCode int, contentType string, body []byte) {
+	var lock idempotentResponse
+	data, err := database.RedisClient.Get(context.Background(), redisKey).Bytes()
+	if err == nil {
+		err = sonic.Unmarshal(data, &lock)
+	}
+	if err != nil {
+		log.Println("Idempotency lock:", err)
+		ReleaseIdempotencyKey(redisKey)
+		return
+	}
+
+	data, err = sonic.Marshal(&idempotentResponse{
+		Status:      idempotencyCompleted,
+		BodyHash:    lock.BodyHash,
+		StatusCode:  statusCode,
+		ContentType: contentType,
+		Body:        body,
+	})
+	if err != nil {
+		log.Println("Marshal:", err)
+		ReleaseIdempotencyKey(redisKey)
+		return
+	}
+
+	err = database.RedisClient.Set(context.Background(), redisKey, data, config.IdempotencyKeyTTL).Err()
+	if err != nil {
+		log.Println("Redis:", err)
+	}
+}
+
+// ReleaseIdempotencyKey frees the key so the request can be retried.
+func ReleaseIdempotencyKey(redisKey string) {
+	err := database.RedisClient.Del(context.Background(), redisKey).Err()
+	if err != nil {
+		log.Println("Redis:", err)
+	}
+}
@@ -0,0 +1,166 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// WebhookSignatureHeader carries the hex HMAC-SHA256 of the request body,
+// optionally prefixed with "sha256=".
+const WebhookSignatureHeader = "X-Webhook-Signature"
+
+var (
+	errMissingBearer    = errors.New("missing bearer token")
+	errInvalidBearer    = errors.New("invalid bearer token")
+	errMissingSignature = errors.New("missing body signature")
+	errInvalidSignature = errors.New("invalid body signature")
+	errNoSecrets        = errors.New("no webhook secrets configured")
+)
+
+// WebhookAuthenticator decides whether a webhook delivery is genuine.
+type WebhookAuthenticator interface {
+	Authenticate(c *fiber.Ctx) error
+}
+
+// BearerAuthenticator accepts an Authorization bearer token matching any of
+// Secrets, so a new secret can be rolled out before the old one is retired.
+type BearerAuthenticator struct {
+	Secrets []string
+}
+
+func (a BearerAuthenticator) Authenticate(c *fiber.Ctx) error {
+	header := c.Get(fiber.HeaderAuthorization)
+	token := strings.TrimPrefix(header, "Bearer ")
+	if token == header || token == "" {
+		return errMissingBearer
+	}
+
+	if len(a.Secrets) == 0 {
+		return errNoSecrets
+	}
+
+	if !matchesAnySecret(token, a.Secrets) {
+		return errInvalidBearer
+	}
+
+	return nil
+}
+
+// SignatureAuthenticator accepts a body signed with HMAC-SHA256 under any of
+// Secrets.
+type SignatureAuthenticator struct {
+	Secrets []string
+}
+
+func (a SignatureAuthenticator) Authenticate(c *fiber.Ctx) error {
+	header := strings.TrimPrefix(c.Get(WebhookSignatureHeader), "sha256=")
+	if header == "" {
+		return errMissingSignature
+	}
+
+	if len(a.Secrets) == 0 {
+		return errNoSecrets
+	}
+
+	signature, err := hex.DecodeString(header)
+	if err != nil {
+		return errInvalidSignature
+	}
+
+	valid := false
+	for _, secret := range a.Secrets {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(c.Body())
+		if hmac.Equal(signature, mac.Sum(nil)) {
+			valid = true
+		}
+	}
+
+	if !valid {
+		return errInvalidSignature
+	}
+
+	return nil
+}
+
+// AllWebhookAuthenticators requires every one of its authenticators to pass.
+type AllWebhookAuthenticators []WebhookAuthenticator
+
+func (a AllWebhookAuthenticators) Authenticate(c *fiber.Ctx) error {
+	if len(a) == 0 {
+		return errNoSecrets
+	}
+
+	for _, authenticator := range a {
+		if err := authenticator.Authenticate(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// matchesAnySecret compares token against every secret in constant time.
+// Hashing first keeps the comparison from leaking the secrets' lengths.
+func matchesAnySecret(token string, secrets []string) bool {
+	tokenSum := sha256.Sum256([]byte(token))
+
+	matched := false
+	for _, secret := range secrets {
+		secretSum := sha256.Sum256([]byte(secret))
+		if hmac.Equal(tokenSum[:], secretSum[:]) {
+			matched = true
+		}
+	}
+
+	return matched
+}
+
+// splitSecrets parses a comma-separated list of secrets.
+func splitSecrets(value string) []string {
+	secrets := []string{}
+	for _, secret := range strings.Split(value, ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+
+	return secrets
+}
+
+// NewWebhookAuthenticator reads the accepted bearer tokens from the
+// comma-separated WEBHOOK_BEARER and, when WEBHOOK_SIGNING_SECRETS is set,
+// also requires a body signature under one of those secrets.
+func NewWebhookAuthenticator() WebhookAuthenticator {
+	authenticators := AllWebhookAuthenticators{
+		BearerAuthenticator{Secrets: splitSecrets(os.Getenv("WEBHOOK_BEARER"))},
+	}
+
+	if signing := splitSecrets(os.Getenv("WEBHOOK_SIGNING_SECRETS")); len(signing) > 0 {
+		authenticators = append(authenticators, SignatureAuthenticator{Secrets: signing})
+	}
+
+	return authenticators
+}
+
+// WebhookAuth rejects deliveries the authenticator does not accept, logging
+// each rejection with the address it came from.
+func WebhookAuth(authenticator WebhookAuthenticator) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if err := authenticator.Authenticate(c); err != nil {
+			log.Printf("Webhook %s rejected from %s: %v", c.Path(), c.IP(), err)
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Unauthorized",
+			})
+		}
+
+		return c.Next()
+	}
+}
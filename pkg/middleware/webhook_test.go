@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func sign(secret string, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhookAuth(t *testing.T) {
+	body := `{"event":{"id":"1"}}`
+
+	bearer := BearerAuthenticator{Secrets: []string{"old-secret", "new-secret"}}
+	signed := AllWebhookAuthenticators{bearer, SignatureAuthenticator{Secrets: []string{"signing"}}}
+
+	tests := []struct {
+		description   string
+		authenticator WebhookAuthenticator
+		headers       map[string]string
+		expectedCode  int
+	}{
+		{
+			description:   "current secret",
+			authenticator: bearer,
+			headers:       map[string]string{"Authorization": "Bearer new-secret"},
+			expectedCode:  fiber.StatusOK,
+		},
+		{
+			description:   "secret being rotated out",
+			authenticator: bearer,
+			headers:       map[string]string{"Authorization": "Bearer old-secret"},
+			expectedCode:  fiber.StatusOK,
+		},
+		{
+			description:   "wrong secret",
+			authenticator: bearer,
+			headers:       map[string]string{"Authorization": "Bearer new-secre"},
+			expectedCode:  fiber.StatusUnauthorized,
+		},
+		{
+			description:   "missing bearer prefix",
+			authenticator: bearer,
+			headers:       map[string]string{"Authorization": "new-secret"},
+			expectedCode:  fiber.StatusUnauthorized,
+		},
+		{
+			description:   "no secrets configured",
+			authenticator: BearerAuthenticator{},
+			headers:       map[string]string{"Authorization": "Bearer "},
+			expectedCode:  fiber.StatusUnauthorized,
+		},
+		{
+			description:   "valid body signature",
+			authenticator: signed,
+			headers: map[string]string{
+				"Authorization":        "Bearer new-secret",
+				WebhookSignatureHeader: "sha256=" + sign("signing", body),
+			},
+			expectedCode: fiber.StatusOK,
+		},
+		{
+			description:   "signature of another body",
+			authenticator: signed,
+			headers: map[string]string{
+				"Authorization":        "Bearer new-secret",
+				WebhookSignatureHeader: sign("signing", body+" "),
+			},
+			expectedCode: fiber.StatusUnauthorized,
+		},
+		{
+			description:   "missing signature",
+			authenticator: signed,
+			headers:       map[string]string{"Authorization": "Bearer new-secret"},
+			expectedCode:  fiber.StatusUnauthorized,
+		},
+	}
+
+	for _, test := range tests {
+		app := fiber.New()
+		app.Post("/hook", WebhookAuth(test.authenticator), func(c *fiber.Ctx) error {
+			return c.SendStatus(fiber.StatusOK)
+		})
+
+		req := httptest.NewRequest("POST", "/hook", strings.NewReader(body))
+		for key, value := range test.headers {
+			req.Header.Set(key, value)
+		}
+
+		res, err := app.Test(req, -1)
+		assert.NoErrorf(t, err, test.description)
+		assert.Equalf(t, test.expectedCode, res.StatusCode, test.description)
+	}
+}
+
+func TestNewWebhookAuthenticator(t *testing.T) {
+	t.Setenv("WEBHOOK_BEARER", " first, second ,")
+	t.Setenv("WEBHOOK_SIGNING_SECRETS", "")
+
+	authenticators := NewWebhookAuthenticator().(AllWebhookAuthenticators)
+	assert.Equal(t, AllWebhookAuthenticators{BearerAuthenticator{Secrets: []string{"first", "second"}}}, authenticators)
+
+	t.Setenv("WEBHOOK_SIGNING_SECRETS", "signing")
+	assert.Len(t, NewWebhookAuthenticator().(AllWebhookAuthenticators), 2)
+}
@@ -1,6 +1,10 @@
 package model
 
-import "gorm.io/gorm"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
 
 type VerificationCode struct {
 	*gorm.Model
@@ -38,3 +42,12 @@ type ActivateUserTrialParams struct {
 type CheckTrialPlanParams struct {
 	UserId string `json:"user_id"`
 }
+
+// AccountAlias maps a RevenueCat app user ID, such as an anonymous ID from
+// before the user signed in, to the Firebase UID that owns the account.
+type AccountAlias struct {
+	Alias     string    `json:"alias" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at"`
+
+	UserID string `json:"user_id" gorm:"index"`
+}
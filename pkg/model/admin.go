@@ -0,0 +1,74 @@
+package model
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// AuditLog is an append-only record of an action taken through the admin API.
+type AuditLog struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+
+	ActorUID     string `json:"actor_uid" gorm:"index"`
+	Action       string `json:"action"`
+	TargetUserID string `json:"target_user_id" gorm:"index"`
+	Reason       string `json:"reason"`
+	Details      string `json:"details"`
+}
+
+func (AuditLog) BeforeUpdate(tx *gorm.DB) error {
+	return ErrImmutableAuditLog
+}
+
+func (AuditLog) BeforeDelete(tx *gorm.DB) error {
+	return ErrImmutableAuditLog
+}
+
+type CreditAdjustment struct {
+	*gorm.Model
+
+	UserID        string     `json:"user_id" gorm:"index"`
+	Amount        Credits    `json:"amount"`
+	Reason        string     `json:"reason"`
+	ActorUID      string     `json:"actor_uid"`
+	LedgerEntryID uint       `json:"ledger_entry_id"`
+	RevertedBy    string     `json:"reverted_by"`
+	RevertedAt    *time.Time `json:"reverted_at"`
+}
+
+type CreditAdjustmentParams struct {
+	Amount Credits `json:"amount"`
+	Reason string  `json:"reason"`
+}
+
+type RevertCreditAdjustmentParams struct {
+	Reason string `json:"reason"`
+}
+
+type AdminUserDetails struct {
+	Credits     *UserCredits       `json:"credits"`
+	Trial       *UserTrialData     `json:"trial"`
+	Buckets     []CreditBucket     `json:"buckets"`
+	Ledger      []LedgerEntry      `json:"ledger"`
+	Adjustments []CreditAdjustment `json:"adjustments"`
+	Flags       []AccountFlag      `json:"flags"`
+	Aliases     []AccountAlias     `json:"aliases"`
+}
+
+// AccountFlag marks an account for manual review until an admin resolves it.
+type AccountFlag struct {
+	*gorm.Model
+
+	UserID     string     `json:"user_id" gorm:"index"`
+	Reason     string     `json:"reason"`
+	Details    string     `json:"details" gorm:"type:jsonb"`
+	ResolvedBy string     `json:"resolved_by"`
+	ResolvedAt *time.Time `json:"resolved_at"`
+	Resolution string     `json:"resolution"`
+}
+
+type ResolveAccountFlagParams struct {
+	Resolution string `json:"resolution"`
+}
@@ -0,0 +1,23 @@
+package model
+
+type OpenRouterModel struct {
+	ID            string                  `json:"id"`
+	Name          string                  `json:"name"`
+	ContextLength int                     `json:"context_length"`
+	Pricing       OpenRouterModelPricing  `json:"pricing"`
+	TopProvider   OpenRouterModelProvider `json:"top_provider"`
+}
+
+// Prices are USD per token, sent as strings by OpenRouter
+type OpenRouterModelPricing struct {
+	Prompt     string `json:"prompt"`
+	Completion string `json:"completion"`
+}
+
+type OpenRouterModelProvider struct {
+	MaxCompletionTokens int `json:"max_completion_tokens"`
+}
+
+type OpenRouterModelsResponse struct {
+	Data []OpenRouterModel `json:"data"`
+}
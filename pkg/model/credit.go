@@ -11,14 +11,14 @@ type UserCredits struct {
 
 	UserID               string  `json:"user_id" gorm:"primaryKey"`
 	PurchasedTimestampMs int64   `json:"purchased_timestamp_ms"`
-	CreditAmount         float64 `json:"credit_amount"`
+	CreditAmount         Credits `json:"credit_amount"`
 }
 
 type CreditUsageHistory struct {
 	*gorm.Model
 
 	UserID       string    `json:"user_id"`
-	Amount       float64   `json:"amount"`
+	Amount       Credits   `json:"amount"`
 	Timestamp    time.Time `json:"timestamp"`
 	RequestType  string    `json:"request_type"`
 	GenerationID string    `json:"generation_id"`
@@ -46,9 +46,76 @@ type Receipt struct {
 	NativeTokensCompletion float64 `json:"native_tokens_completion"`
 	NumMediaGenerations    float64 `json:"num_media_generations"`
 	Origin                 string  `json:"origin"`
-	Usage                  float64 `json:"usage"`
+	Usage                  Credits `json:"usage"`
+	Finalized              bool    `json:"-"`
 }
 
 type ReceiptResponse struct {
 	Data Receipt `json:"data"`
 }
+
+type CreditHistoryParams struct {
+	Cursor      uint   `query:"cursor"`
+	Limit       int    `query:"limit"`
+	RequestType string `query:"request_type"`
+	From        string `query:"from"`
+	To          string `query:"to"`
+}
+
+type CreditHistoryItem struct {
+	ID               uint      `json:"id"`
+	RequestType      string    `json:"request_type"`
+	Amount           Credits   `json:"amount"`
+	Timestamp        time.Time `json:"timestamp"`
+	GenerationID     string    `json:"generation_id,omitempty"`
+	Model            string    `json:"model,omitempty"`
+	TokensPrompt     float64   `json:"tokens_prompt,omitempty"`
+	TokensCompletion float64   `json:"tokens_completion,omitempty"`
+	Cost             Credits   `json:"cost,omitempty"`
+}
+
+type CreditHistoryResponse struct {
+	Items      []CreditHistoryItem `json:"items"`
+	NextCursor uint                `json:"next_cursor,omitempty"`
+}
+
+// CreditBucket tracks what is left of a single credit grant. The buckets of a
+// user add up to UserCredits.CreditAmount unless the balance is negative.
+type CreditBucket struct {
+	*gorm.Model
+
+	UserID        string     `json:"user_id" gorm:"index"`
+	Kind          string     `json:"kind"`
+	Granted       Credits    `json:"granted"`
+	Remaining     Credits    `json:"remaining"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+	LedgerEntryID uint       `json:"ledger_entry_id" gorm:"uniqueIndex:idx_credit_buckets_ledger_entry,where:ledger_entry_id > 0"`
+}
+
+type CreditBucketSummary struct {
+	ID        uint       `json:"id"`
+	Kind      string     `json:"kind"`
+	Granted   Credits    `json:"granted"`
+	Remaining Credits    `json:"remaining"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type CreditDetails struct {
+	UserCredits
+	Buckets []CreditBucketSummary `json:"buckets"`
+}
+
+// SpendingLimit holds the optional caps a user puts on their own snap and
+// chat spending. A nil cap is not enforced.
+type SpendingLimit struct {
+	*gorm.Model
+
+	UserID     string   `json:"user_id" gorm:"uniqueIndex"`
+	DailyCap   *Credits `json:"daily_cap"`
+	MonthlyCap *Credits `json:"monthly_cap"`
+}
+
+type SpendingLimitParams struct {
+	DailyCap   *Credits `json:"daily_cap"`
+	MonthlyCap *Credits `json:"monthly_cap"`
+}
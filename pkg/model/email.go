@@ -6,4 +6,6 @@ type EmailData struct {
 	PurchaseTime     string `json:"purchase_time"`
 	ExpirationTime   string `json:"expiration_time"`
 	Price            string `json:"price"`
+	NewPlan          string `json:"new_plan"`
+	ResumeTime       string `json:"resume_time"`
 }
@@ -1,42 +1,106 @@
 package model
 
+import "time"
+
 type WebhookPayload struct {
 	APIVersion string `json:"api_version"`
 	Event      Event  `json:"event"`
 }
 
 type Event struct {
-	Aliases                  []string             `json:"aliases"`
-	AppID                    string               `json:"app_id"`
-	AppUserID                string               `json:"app_user_id"`
-	CommissionPercentage     float64              `json:"commission_percentage"`
-	CountryCode              string               `json:"country_code"`
-	Currency                 string               `json:"currency"`
-	EntitlementID            string               `json:"entitlement_id"`
-	EntitlementIDs           []string             `json:"entitlement_ids"`
-	Environment              string               `json:"environment"`
-	EventTimestampMs         int64                `json:"event_timestamp_ms"`
-	ExpirationAtMs           int64                `json:"expiration_at_ms"`
-	ID                       string               `json:"id"`
-	IsFamilyShare            bool                 `json:"is_family_share"`
-	OfferCode                string               `json:"offer_code"`
-	OriginalAppUserID        string               `json:"original_app_user_id"`
-	OriginalTransactionID    string               `json:"original_transaction_id"`
-	PeriodType               string               `json:"period_type"`
-	PresentedOfferingID      string               `json:"presented_offering_id"`
-	Price                    float64              `json:"price"`
-	PriceInPurchasedCurrency float64              `json:"price_in_purchased_currency"`
-	ProductID                string               `json:"product_id"`
-	PurchasedAtMs            int64                `json:"purchased_at_ms"`
-	Store                    string               `json:"store"`
-	SubscriberAttributes     map[string]Attribute `json:"subscriber_attributes"`
-	TakehomePercentage       float64              `json:"takehome_percentage"`
-	TaxPercentage            float64              `json:"tax_percentage"`
-	TransactionID            string               `json:"transaction_id"`
-	Type                     string               `json:"type"`
+	Aliases                   []string             `json:"aliases"`
+	AppID                     string               `json:"app_id"`
+	AppUserID                 string               `json:"app_user_id"`
+	AutoResumeAtMs            int64                `json:"auto_resume_at_ms"`
+	CancelReason              string               `json:"cancel_reason"`
+	CommissionPercentage      float64              `json:"commission_percentage"`
+	CountryCode               string               `json:"country_code"`
+	Currency                  string               `json:"currency"`
+	EntitlementID             string               `json:"entitlement_id"`
+	EntitlementIDs            []string             `json:"entitlement_ids"`
+	Environment               string               `json:"environment"`
+	EventTimestampMs          int64                `json:"event_timestamp_ms"`
+	ExpirationAtMs            int64                `json:"expiration_at_ms"`
+	ExpirationReason          string               `json:"expiration_reason"`
+	GracePeriodExpirationAtMs int64                `json:"grace_period_expiration_at_ms"`
+	ID                        string               `json:"id"`
+	IsFamilyShare             bool                 `json:"is_family_share"`
+	NewProductID              string               `json:"new_product_id"`
+	OfferCode                 string               `json:"offer_code"`
+	OriginalAppUserID         string               `json:"original_app_user_id"`
+	OriginalTransactionID     string               `json:"original_transaction_id"`
+	PeriodType                string               `json:"period_type"`
+	PresentedOfferingID       string               `json:"presented_offering_id"`
+	Price                     float64              `json:"price"`
+	PriceInPurchasedCurrency  float64              `json:"price_in_purchased_currency"`
+	ProductID                 string               `json:"product_id"`
+	PurchasedAtMs             int64                `json:"purchased_at_ms"`
+	Store                     string               `json:"store"`
+	SubscriberAttributes      map[string]Attribute `json:"subscriber_attributes"`
+	TakehomePercentage        float64              `json:"takehome_percentage"`
+	TaxPercentage             float64              `json:"tax_percentage"`
+	TransactionID             string               `json:"transaction_id"`
+	TransferredFrom           []string             `json:"transferred_from"`
+	TransferredTo             []string             `json:"transferred_to"`
+	Type                      string               `json:"type"`
 }
 
 type Attribute struct {
 	UpdatedAtMs int64  `json:"updated_at_ms"`
 	Value       string `json:"value"`
 }
+
+// WebhookEvent is every RevenueCat delivery we have received, keyed on the
+// RevenueCat event ID so redeliveries are recognized.
+type WebhookEvent struct {
+	ID        string    `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Type          string     `json:"type" gorm:"index"`
+	AppUserID     string     `json:"app_user_id" gorm:"index"`
+	TransactionID string     `json:"transaction_id"`
+	Environment   string     `json:"environment" gorm:"index"`
+	Store         string     `json:"store"`
+	Price         float64    `json:"price"`
+	Payload       string     `json:"payload" gorm:"type:jsonb"`
+	Status        string     `json:"status" gorm:"index"`
+	Error         string     `json:"error"`
+	Attempts      int        `json:"attempts"`
+	ProcessedAt   *time.Time `json:"processed_at"`
+}
+
+// RevenueReport sums the USD price of production store events per store.
+// Refunds are reported by RevenueCat with a negative price.
+type RevenueReport struct {
+	From   time.Time     `json:"from"`
+	To     time.Time     `json:"to"`
+	Stores []RevenueLine `json:"stores"`
+	Net    float64       `json:"net"`
+}
+
+type RevenueLine struct {
+	Store     string  `json:"store"`
+	Purchases int64   `json:"purchases"`
+	Refunds   int64   `json:"refunds"`
+	Gross     float64 `json:"gross"`
+	Refunded  float64 `json:"refunded"`
+	Net       float64 `json:"net"`
+}
+
+// QueueStats counts the jobs of a background queue by state.
+type QueueStats struct {
+	Name         string `json:"name"`
+	Queued       int64  `json:"queued"`
+	Processing   int64  `json:"processing"`
+	Retrying     int64  `json:"retrying"`
+	DeadLettered int64  `json:"dead_lettered"`
+}
+
+type RequeueWebhookEventParams struct {
+	Reason string `json:"reason"`
+}
+
+type ReprocessWebhookEventParams struct {
+	Reason string `json:"reason"`
+}
@@ -0,0 +1,53 @@
+package model
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrImmutableLedgerEntry = errors.New("ledger entries are immutable")
+	ErrImmutableAuditLog    = errors.New("audit logs are immutable")
+)
+
+// LedgerEntry records credits moving from DebitAccount to CreditAccount.
+// One of the two accounts is always the user's, the other a system account.
+// Entries are append-only; corrections are posted as new entries.
+type LedgerEntry struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+
+	UserID        string  `json:"user_id" gorm:"index"`
+	EntryType     string  `json:"entry_type" gorm:"uniqueIndex:idx_ledger_source"`
+	DebitAccount  string  `json:"debit_account"`
+	CreditAccount string  `json:"credit_account"`
+	Amount        Credits `json:"amount"`
+	BalanceAfter  Credits `json:"balance_after"`
+	SourceType    string  `json:"source_type" gorm:"uniqueIndex:idx_ledger_source"`
+	SourceID      string  `json:"source_id" gorm:"uniqueIndex:idx_ledger_source"`
+	Memo          string  `json:"memo"`
+	Environment   string  `json:"environment" gorm:"index;default:PRODUCTION"`
+}
+
+func (LedgerEntry) BeforeUpdate(tx *gorm.DB) error {
+	return ErrImmutableLedgerEntry
+}
+
+func (LedgerEntry) BeforeDelete(tx *gorm.DB) error {
+	return ErrImmutableLedgerEntry
+}
+
+// CreditHold reserves part of a user's balance for a charge whose final
+// amount is only known later. Active holds past ExpiresAt no longer count
+// against the balance and are swept to RELEASED.
+type CreditHold struct {
+	*gorm.Model
+
+	UserID    string    `json:"user_id" gorm:"index"`
+	Amount    Credits   `json:"amount"`
+	Status    string    `json:"status" gorm:"index"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Reason    string    `json:"reason"`
+}
@@ -0,0 +1,104 @@
+package model
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"strconv"
+)
+
+// MicroCreditsPerCredit is the scale of Credits: one credit (1 USD) is
+// stored as one million micro-credits.
+const MicroCreditsPerCredit = 1000000
+
+// Credits is an exact amount of credits held as integer micro-credits. It is
+// stored as a BIGINT column and reads and writes JSON as a decimal number, so
+// 0.01 credits is stored as 10000 and still rendered as 0.01.
+//
+// Amounts with more than six decimals, such as provider costs, are rounded
+// to the nearest micro-credit with ties away from zero. Arithmetic on Credits
+// is plain integer arithmetic and never rounds.
+type Credits int64
+
+// NewCredits converts a decimal amount into Credits. The float is read by its
+// shortest decimal representation, so 0.01 becomes exactly 10000.
+func NewCredits(amount float64) Credits {
+	credits, err := ParseCredits(strconv.FormatFloat(amount, 'g', -1, 64))
+	if err != nil {
+		return 0
+	}
+
+	return credits
+}
+
+// ParseCredits reads a decimal string, with an optional exponent, into Credits.
+func ParseCredits(value string) (Credits, error) {
+	amount, ok := new(big.Rat).SetString(value)
+	if !ok {
+		return 0, fmt.Errorf("invalid credit amount %q", value)
+	}
+
+	amount.Mul(amount, new(big.Rat).SetInt64(MicroCreditsPerCredit))
+
+	quotient, remainder := new(big.Int).QuoRem(amount.Num(), amount.Denom(), new(big.Int))
+
+	// Round half away from zero
+	remainder.Abs(remainder).Lsh(remainder, 1)
+	if remainder.Cmp(amount.Denom()) >= 0 {
+		if amount.Sign() < 0 {
+			quotient.Sub(quotient, big.NewInt(1))
+		} else {
+			quotient.Add(quotient, big.NewInt(1))
+		}
+	}
+
+	if !quotient.IsInt64() {
+		return 0, fmt.Errorf("credit amount %q out of range", value)
+	}
+
+	return Credits(quotient.Int64()), nil
+}
+
+// Float64 is for display and ratios only, never for further credit math.
+func (c Credits) Float64() float64 {
+	return float64(c) / MicroCreditsPerCredit
+}
+
+func (c Credits) String() string {
+	sign := ""
+	magnitude := uint64(c)
+	if c < 0 {
+		sign = "-"
+		magnitude = uint64(-c)
+	}
+
+	whole := magnitude / MicroCreditsPerCredit
+	fraction := magnitude % MicroCreditsPerCredit
+	if fraction == 0 {
+		return sign + strconv.FormatUint(whole, 10)
+	}
+
+	digits := []byte(fmt.Sprintf("%06d", fraction))
+	digits = bytes.TrimRight(digits, "0")
+	return sign + strconv.FormatUint(whole, 10) + "." + string(digits)
+}
+
+func (c Credits) MarshalJSON() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// UnmarshalJSON accepts a JSON number or a numeric string.
+func (c *Credits) UnmarshalJSON(data []byte) error {
+	value := string(bytes.Trim(data, `"`))
+	if value == "null" || value == "" {
+		return nil
+	}
+
+	credits, err := ParseCredits(value)
+	if err != nil {
+		return err
+	}
+
+	*c = credits
+	return nil
+}
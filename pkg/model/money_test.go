@@ -0,0 +1,87 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewCredits(t *testing.T) {
+	tests := []struct {
+		description string
+		amount      float64
+		expected    Credits
+	}{
+		{"snap price", 0.01, 10000},
+		{"equation price", 0.02, 20000},
+		{"whole credits", 15, 15000000},
+		{"provider cost rounds half up", 0.0000135, 14},
+		{"provider cost rounds down", 0.0000134, 13},
+		{"negative rounds away from zero", -0.0000135, -14},
+		{"zero", 0, 0},
+	}
+
+	for _, tc := range tests {
+		assert.Equal(t, tc.expected, NewCredits(tc.amount), tc.description)
+	}
+}
+
+func TestCreditsDoNotDrift(t *testing.T) {
+	balance := NewCredits(100)
+	for i := 0; i < 10000; i++ {
+		balance -= NewCredits(0.01)
+	}
+
+	assert.Equal(t, Credits(0), balance)
+}
+
+func TestCreditsJSON(t *testing.T) {
+	tests := []struct {
+		description string
+		credits     Credits
+		json        string
+	}{
+		{"fraction", 10000, "0.01"},
+		{"whole", 5000000, "5"},
+		{"mixed", 1234567, "1.234567"},
+		{"negative", -1500000, "-1.5"},
+		{"zero", 0, "0"},
+	}
+
+	for _, tc := range tests {
+		data, err := tc.credits.MarshalJSON()
+		assert.Nil(t, err, tc.description)
+		assert.Equal(t, tc.json, string(data), tc.description)
+
+		var parsed Credits
+		assert.Nil(t, parsed.UnmarshalJSON(data), tc.description)
+		assert.Equal(t, tc.credits, parsed, tc.description)
+	}
+}
+
+func TestCreditsUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		description string
+		json        string
+		expected    Credits
+		expectError bool
+	}{
+		{"number", "0.1", 100000, false},
+		{"exponent", "1.35e-05", 14, false},
+		{"string", `"0.02"`, 20000, false},
+		{"integer", "10", 10000000, false},
+		{"invalid", `"abc"`, 0, true},
+	}
+
+	for _, tc := range tests {
+		var parsed Credits
+		err := parsed.UnmarshalJSON([]byte(tc.json))
+		if tc.expectError {
+			assert.NotNil(t, err, tc.description)
+			continue
+		}
+
+		assert.Nil(t, err, tc.description)
+		assert.Equal(t, tc.expected, parsed, tc.description)
+	}
+}
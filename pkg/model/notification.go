@@ -0,0 +1,35 @@
+package model
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// BalanceAlert marks a low-balance threshold the user is currently below and
+// has been notified about. It is removed once the balance rises above the
+// threshold again, so the next crossing notifies anew.
+type BalanceAlert struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at"`
+
+	UserID    string  `json:"user_id" gorm:"uniqueIndex:idx_balance_alert"`
+	Threshold Credits `json:"threshold" gorm:"uniqueIndex:idx_balance_alert"`
+}
+
+type NotificationPreference struct {
+	*gorm.Model
+
+	UserID           string `json:"user_id" gorm:"uniqueIndex"`
+	LowBalanceOptOut bool   `json:"low_balance_opt_out"`
+}
+
+type NotificationPreferenceParams struct {
+	LowBalanceEmails bool `json:"low_balance_emails"`
+}
+
+type BalanceEmailData struct {
+	Balance   string `json:"balance"`
+	Threshold string `json:"threshold"`
+	Depleted  bool   `json:"depleted"`
+}
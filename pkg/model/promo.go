@@ -0,0 +1,46 @@
+package model
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type PromoCode struct {
+	*gorm.Model
+
+	Code               string     `json:"code" gorm:"uniqueIndex"`
+	Amount             Credits    `json:"amount"`
+	MaxRedemptions     int        `json:"max_redemptions"`
+	PerUserLimit       int        `json:"per_user_limit"`
+	Redemptions        int        `json:"redemptions"`
+	ValidFrom          *time.Time `json:"valid_from"`
+	ValidUntil         *time.Time `json:"valid_until"`
+	TargetPlan         string     `json:"target_plan"`
+	CreditValidityDays int        `json:"credit_validity_days"`
+	CreatedBy          string     `json:"created_by"`
+}
+
+type PromoRedemption struct {
+	*gorm.Model
+
+	PromoCodeID   uint    `json:"promo_code_id" gorm:"index"`
+	UserID        string  `json:"user_id" gorm:"index"`
+	Amount        Credits `json:"amount"`
+	LedgerEntryID uint    `json:"ledger_entry_id"`
+}
+
+type CreatePromoCodeParams struct {
+	Code               string     `json:"code"`
+	Amount             Credits    `json:"amount"`
+	MaxRedemptions     int        `json:"max_redemptions"`
+	PerUserLimit       int        `json:"per_user_limit"`
+	ValidFrom          *time.Time `json:"valid_from"`
+	ValidUntil         *time.Time `json:"valid_until"`
+	TargetPlan         string     `json:"target_plan"`
+	CreditValidityDays int        `json:"credit_validity_days"`
+}
+
+type RedeemPromoCodeParams struct {
+	Code string `json:"code"`
+}
@@ -0,0 +1,39 @@
+package model
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ReconciliationReport summarizes one run of the chat receipt reconciliation.
+type ReconciliationReport struct {
+	*gorm.Model
+
+	RunDate    string    `json:"run_date" gorm:"uniqueIndex:idx_reconciliation_reports_run_date,where:run_date <> ''"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Checked    int       `json:"checked"`
+	Corrected  int       `json:"corrected"`
+	Pending    int       `json:"pending"`
+	Failed     int       `json:"failed"`
+	Charged    Credits   `json:"charged"`
+	Refunded   Credits   `json:"refunded"`
+
+	Discrepancies []ReconciliationDiscrepancy `json:"discrepancies" gorm:"foreignKey:ReportID"`
+}
+
+// ReconciliationDiscrepancy is a chat charge that differed from the final
+// OpenRouter usage. Difference is Actual minus Charged.
+type ReconciliationDiscrepancy struct {
+	*gorm.Model
+
+	ReportID      uint    `json:"report_id" gorm:"index"`
+	ReceiptID     string  `json:"receipt_id"`
+	UserID        string  `json:"user_id" gorm:"index"`
+	ModelType     string  `json:"model"`
+	Charged       Credits `json:"charged"`
+	Actual        Credits `json:"actual"`
+	Difference    Credits `json:"difference"`
+	LedgerEntryID uint    `json:"ledger_entry_id"`
+}
@@ -0,0 +1,33 @@
+package model
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type ReferralCode struct {
+	*gorm.Model
+
+	UserID   string `json:"user_id" gorm:"uniqueIndex"`
+	Code     string `json:"code" gorm:"uniqueIndex"`
+	Email    string `json:"-"`
+	DeviceID string `json:"-"`
+}
+
+type Referral struct {
+	*gorm.Model
+
+	ReferrerID   string     `json:"referrer_id" gorm:"index"`
+	RefereeID    string     `json:"referee_id" gorm:"uniqueIndex"`
+	RefereeEmail string     `json:"-" gorm:"uniqueIndex:idx_referrals_referee_email,where:referee_email <> ''"`
+	DeviceID     string     `json:"-"`
+	Status       string     `json:"status"`
+	Trigger      string     `json:"trigger"`
+	RewardedAt   *time.Time `json:"rewarded_at"`
+}
+
+type ApplyReferralCodeParams struct {
+	Code     string `json:"code"`
+	DeviceID string `json:"device_id"`
+}
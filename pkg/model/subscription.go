@@ -0,0 +1,36 @@
+package model
+
+import "gorm.io/gorm"
+
+// Subscription is the current state of a user's auto-renewing plan as
+// last reported by RevenueCat.
+type Subscription struct {
+	*gorm.Model
+
+	UserID                 string `json:"user_id" gorm:"uniqueIndex"`
+	Store                  string `json:"store"`
+	ProductID              string `json:"product_id"`
+	PendingProductID       string `json:"pending_product_id"`
+	Status                 string `json:"status" gorm:"index"`
+	Environment            string `json:"environment"`
+	OriginalTransactionID  string `json:"original_transaction_id" gorm:"index"`
+	TransactionID          string `json:"transaction_id"`
+	PurchasedAtMs          int64  `json:"purchased_at_ms"`
+	ExpirationAtMs         int64  `json:"expiration_at_ms"`
+	GracePeriodExpiresAtMs int64  `json:"grace_period_expires_at_ms"`
+	AutoResumeAtMs         int64  `json:"auto_resume_at_ms"`
+	LastEventID            string `json:"last_event_id"`
+	LastEventAtMs          int64  `json:"last_event_at_ms"`
+}
+
+type SubscriptionStatus struct {
+	Status           string `json:"status"`
+	Store            string `json:"store,omitempty"`
+	ProductID        string `json:"product_id,omitempty"`
+	Plan             string `json:"plan,omitempty"`
+	PendingProductID string `json:"pending_product_id,omitempty"`
+	Entitled         bool   `json:"entitled"`
+	ExpiresAtMs      int64  `json:"expires_at_ms,omitempty"`
+	EntitledUntilMs  int64  `json:"entitled_until_ms,omitempty"`
+	AutoResumeAtMs   int64  `json:"auto_resume_at_ms,omitempty"`
+}
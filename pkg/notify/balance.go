@@ -0,0 +1,106 @@
+package notify
+
+import (
+	"context"
+	"log"
+	"sort"
+
+	"github.com/vndee/lensquery-backend/pkg/config"
+	"github.com/vndee/lensquery-backend/pkg/database"
+	"github.com/vndee/lensquery-backend/pkg/email"
+	"github.com/vndee/lensquery-backend/pkg/model"
+	"gorm.io/gorm/clause"
+)
+
+// BalanceRule fires once each time a user's balance drops to or below
+// Threshold. A rule at zero or below is the out-of-credits notification.
+type BalanceRule struct {
+	Threshold model.Credits
+}
+
+func (r BalanceRule) Depleted() bool {
+	return r.Threshold <= 0
+}
+
+// BalanceRules returns the configured rules, highest threshold first.
+func BalanceRules() []BalanceRule {
+	rules := make([]BalanceRule, 0, len(config.LowBalanceThresholds))
+	for _, threshold := range config.LowBalanceThresholds {
+		rules = append(rules, BalanceRule{Threshold: model.NewCredits(threshold)})
+	}
+
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Threshold > rules[j].Threshold
+	})
+
+	return rules
+}
+
+// BalanceChanged evaluates the balance rules for a user whose balance was
+// just charged down to balance. It runs in the background so callers can
+// invoke it right after committing the charge.
+func BalanceChanged(userID string, balance model.Credits) {
+	go func() {
+		err := checkBalance(userID, balance)
+		if err != nil {
+			log.Println("[Balance notification err]", err)
+		}
+	}()
+}
+
+// checkBalance re-arms the rules the balance is back above, records the rules
+// newly reached and emails the user about the lowest of them.
+func checkBalance(userID string, balance model.Credits) error {
+	err := database.Pool.Where("user_id = ? AND threshold < ?", userID, balance).Delete(&model.BalanceAlert{}).Error
+	if err != nil {
+		return err
+	}
+
+	var reached *BalanceRule
+	for _, rule := range BalanceRules() {
+		if balance > rule.Threshold {
+			continue
+		}
+
+		// The unique index makes the insert the dedupe check
+		response := database.Pool.Clauses(clause.OnConflict{DoNothing: true}).Create(&model.BalanceAlert{
+			UserID:    userID,
+			Threshold: rule.Threshold,
+		})
+		if response.Error != nil {
+			return response.Error
+		}
+
+		if response.RowsAffected > 0 {
+			rule := rule
+			reached = &rule
+		}
+	}
+
+	if reached == nil {
+		return nil
+	}
+
+	var preference model.NotificationPreference
+	err = database.Pool.Where("user_id = ?", userID).Limit(1).Find(&preference).Error
+	if err != nil {
+		return err
+	}
+	if preference.LowBalanceOptOut {
+		return nil
+	}
+
+	user, err := config.FirebaseAuth.GetUser(context.Background(), userID)
+	if err != nil {
+		return err
+	}
+	if user.Email == "" {
+		return nil
+	}
+
+	return email.SendBalanceNotification(user.Email, model.BalanceEmailData{
+		Balance:   balance.String(),
+		Threshold: reached.Threshold.String(),
+		Depleted:  reached.Depleted(),
+	})
+}
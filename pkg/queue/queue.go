@@ -0,0 +1,278 @@
+// Package queue runs background jobs off Redis lists. A job is the ID of a
+// record its processor loads itself; failed jobs are retried with exponential
+// backoff and moved to a dead-letter list once they run out of attempts. A
+// job stays on a processing list under a lease while it runs, so the jobs of
+// a worker that died are queued again once their lease runs out.
+package queue
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/vndee/lensquery-backend/pkg/config"
+	"github.com/vndee/lensquery-backend/pkg/database"
+	"github.com/vndee/lensquery-backend/pkg/model"
+)
+
+// Webhooks holds the IDs of received RevenueCat events waiting to be applied.
+var Webhooks = New("WEBHOOK")
+
+type Queue struct {
+	name string
+}
+
+func New(name string) *Queue {
+	return &Queue{name: name}
+}
+
+func (q *Queue) key(suffix string) string {
+	return q.name + "_" + suffix
+}
+
+// Enqueue schedules id for processing as soon as a worker is free.
+func (q *Queue) Enqueue(ctx context.Context, id string) error {
+	return database.RedisClient.LPush(ctx, q.key("QUEUE"), id).Err()
+}
+
+// Start runs a worker applying process to every job, moves retries back onto
+// the queue once they are due, and queues again the jobs whose lease ran out.
+func (q *Queue) Start(process func(id string) error) {
+	go q.work(process)
+	go q.promoteRetries()
+	go q.recoverExpiredLeases()
+}
+
+func (q *Queue) work(process func(id string) error) {
+	ctx := context.Background()
+	for {
+		id, err := database.RedisClient.BRPopLPush(ctx, q.key("QUEUE"), q.key("PROCESSING"), config.QueuePollInterval*5).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			log.Printf("[Queue %s] Pop: %v", q.name, err)
+			time.Sleep(config.QueuePollInterval)
+			continue
+		}
+
+		err = database.RedisClient.ZAdd(ctx, q.key("LEASES"), &redis.Z{
+			Score:  float64(time.Now().Add(config.QueueLeaseTimeout).UnixMilli()),
+			Member: id,
+		}).Err()
+		if err != nil {
+			log.Printf("[Queue %s] Lease %s: %v", q.name, id, err)
+		}
+
+		q.handle(ctx, id, process)
+
+		_, err = database.RedisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.LRem(ctx, q.key("PROCESSING"), 1, id)
+			pipe.ZRem(ctx, q.key("LEASES"), id)
+			return nil
+		})
+		if err != nil {
+			log.Printf("[Queue %s] Finish %s: %v", q.name, id, err)
+		}
+	}
+}
+
+func (q *Queue) recoverExpiredLeases() {
+	ctx := context.Background()
+	q.requeueExpired(ctx)
+
+	ticker := time.NewTicker(config.QueueLeaseTimeout)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		q.requeueExpired(ctx)
+	}
+}
+
+// requeueExpired moves the jobs whose lease ran out from the processing list
+// back onto the queue, leaving the jobs other workers are still running. A
+// job that outlives its lease may run twice, so processors must skip the jobs
+// they already applied.
+func (q *Queue) requeueExpired(ctx context.Context) {
+	processing, err := database.RedisClient.LRange(ctx, q.key("PROCESSING"), 0, -1).Result()
+	if err != nil {
+		log.Printf("[Queue %s] In-flight jobs: %v", q.name, err)
+		return
+	}
+
+	// A worker that died between popping a job and leasing it left the job
+	// without a lease, so give it one to expire; a live worker overwrites it
+	for _, id := range processing {
+		err := database.RedisClient.ZAddNX(ctx, q.key("LEASES"), &redis.Z{
+			Score:  float64(time.Now().Add(config.QueueLeaseTimeout).UnixMilli()),
+			Member: id,
+		}).Err()
+		if err != nil {
+			log.Printf("[Queue %s] Lease %s: %v", q.name, id, err)
+		}
+	}
+
+	expired, err := database.RedisClient.ZRangeByScore(ctx, q.key("LEASES"), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		log.Printf("[Queue %s] Expired leases: %v", q.name, err)
+		return
+	}
+
+	requeued := 0
+	for _, id := range expired {
+		// Only the worker that removes the lease requeues the job
+		removed, err := database.RedisClient.ZRem(ctx, q.key("LEASES"), id).Result()
+		if err != nil || removed == 0 {
+			continue
+		}
+
+		// A lease left behind by a job that has since finished has nothing to requeue
+		removed, err = database.RedisClient.LRem(ctx, q.key("PROCESSING"), 1, id).Result()
+		if err != nil || removed == 0 {
+			continue
+		}
+
+		if err := q.Enqueue(ctx, id); err != nil {
+			log.Printf("[Queue %s] Requeue %s: %v", q.name, id, err)
+			continue
+		}
+		requeued++
+	}
+
+	if requeued > 0 {
+		log.Printf("[Queue %s] Requeued %d job(s) with an expired lease", q.name, requeued)
+	}
+}
+
+func (q *Queue) handle(ctx context.Context, id string, process func(id string) error) {
+	err := safeProcess(id, process)
+	if err == nil {
+		if err := database.RedisClient.HDel(ctx, q.key("ATTEMPTS"), id).Err(); err != nil {
+			log.Printf("[Queue %s] Clear attempts of %s: %v", q.name, id, err)
+		}
+		return
+	}
+
+	attempts, redisErr := database.RedisClient.HIncrBy(ctx, q.key("ATTEMPTS"), id, 1).Result()
+	if redisErr != nil {
+		log.Printf("[Queue %s] Count attempts of %s: %v", q.name, id, redisErr)
+		return
+	}
+
+	if attempts >= config.QueueMaxAttempts {
+		log.Printf("[Queue %s] Dead-lettering %s after %d attempts: %v", q.name, id, attempts, err)
+		_, redisErr = database.RedisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.LPush(ctx, q.key("DEAD_LETTER"), id)
+			pipe.HDel(ctx, q.key("ATTEMPTS"), id)
+			return nil
+		})
+	} else {
+		delay := Backoff(int(attempts))
+		log.Printf("[Queue %s] Retrying %s in %s after attempt %d: %v", q.name, id, delay, attempts, err)
+		redisErr = database.RedisClient.ZAdd(ctx, q.key("RETRY"), &redis.Z{
+			Score:  float64(time.Now().Add(delay).UnixMilli()),
+			Member: id,
+		}).Err()
+	}
+
+	if redisErr != nil {
+		log.Printf("[Queue %s] Reschedule %s: %v", q.name, id, redisErr)
+	}
+}
+
+// safeProcess turns a panicking job into a failed one.
+func safeProcess(id string, process func(id string) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return process(id)
+}
+
+func (q *Queue) promoteRetries() {
+	ctx := context.Background()
+	ticker := time.NewTicker(config.QueuePollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		due, err := database.RedisClient.ZRangeByScore(ctx, q.key("RETRY"), &redis.ZRangeBy{
+			Min: "-inf",
+			Max: strconv.FormatInt(time.Now().UnixMilli(), 10),
+		}).Result()
+		if err != nil {
+			log.Printf("[Queue %s] Due retries: %v", q.name, err)
+			continue
+		}
+
+		for _, id := range due {
+			// Only the worker that removes the retry requeues it
+			removed, err := database.RedisClient.ZRem(ctx, q.key("RETRY"), id).Result()
+			if err != nil || removed == 0 {
+				continue
+			}
+
+			if err := q.Enqueue(ctx, id); err != nil {
+				log.Printf("[Queue %s] Requeue %s: %v", q.name, id, err)
+			}
+		}
+	}
+}
+
+// Backoff is the delay before retrying a job that failed attempts times:
+// doubling from config.QueueRetryBaseDelay up to config.QueueRetryMaxDelay.
+func Backoff(attempts int) time.Duration {
+	delay := config.QueueRetryBaseDelay
+	for i := 1; i < attempts && delay < config.QueueRetryMaxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > config.QueueRetryMaxDelay {
+		return config.QueueRetryMaxDelay
+	}
+	return delay
+}
+
+// DeadLetters lists up to limit dead-lettered jobs, most recent first.
+func (q *Queue) DeadLetters(ctx context.Context, limit int) ([]string, error) {
+	return database.RedisClient.LRange(ctx, q.key("DEAD_LETTER"), 0, int64(limit-1)).Result()
+}
+
+// Requeue moves a dead-lettered job back onto the queue and reports whether
+// it was dead-lettered.
+func (q *Queue) Requeue(ctx context.Context, id string) (bool, error) {
+	removed, err := database.RedisClient.LRem(ctx, q.key("DEAD_LETTER"), 0, id).Result()
+	if err != nil || removed == 0 {
+		return false, err
+	}
+
+	return true, q.Enqueue(ctx, id)
+}
+
+func (q *Queue) Stats(ctx context.Context) (model.QueueStats, error) {
+	stats := model.QueueStats{Name: q.name}
+	var queued, processing, retrying, dead *redis.IntCmd
+	_, err := database.RedisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		queued = pipe.LLen(ctx, q.key("QUEUE"))
+		processing = pipe.LLen(ctx, q.key("PROCESSING"))
+		retrying = pipe.ZCard(ctx, q.key("RETRY"))
+		dead = pipe.LLen(ctx, q.key("DEAD_LETTER"))
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	stats.Queued = queued.Val()
+	stats.Processing = processing.Val()
+	stats.Retrying = retrying.Val()
+	stats.DeadLettered = dead.Val()
+	return stats, nil
+}
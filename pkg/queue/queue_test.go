@@ -0,0 +1,34 @@
+package queue
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vndee/lensquery-backend/pkg/config"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, config.QueueRetryBaseDelay},
+		{2, 2 * config.QueueRetryBaseDelay},
+		{3, 4 * config.QueueRetryBaseDelay},
+		{5, 16 * config.QueueRetryBaseDelay},
+		{30, config.QueueRetryMaxDelay},
+	}
+
+	for _, test := range tests {
+		assert.Equalf(t, test.expected, Backoff(test.attempts), "attempt %d", test.attempts)
+	}
+}
+
+func TestSafeProcess(t *testing.T) {
+	failure := errors.New("failed")
+	assert.Equal(t, failure, safeProcess("a", func(string) error { return failure }))
+	assert.NoError(t, safeProcess("a", func(string) error { return nil }))
+	assert.EqualError(t, safeProcess("a", func(string) error { panic("boom") }), "panic: boom")
+}
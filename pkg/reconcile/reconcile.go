@@ -0,0 +1,219 @@
+// Package reconcile settles chat charges that were made before OpenRouter had
+// finalized the usage of the generation.
+package reconcile
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/vndee/lensquery-backend/pkg/config"
+	"github.com/vndee/lensquery-backend/pkg/database"
+	"github.com/vndee/lensquery-backend/pkg/ledger"
+	"github.com/vndee/lensquery-backend/pkg/model"
+	"github.com/vndee/lensquery-backend/pkg/notify"
+	"gorm.io/gorm"
+)
+
+type pendingReceipt struct {
+	ReceiptID string
+	UserID    string
+	ModelType string
+	Charged   model.Credits
+}
+
+// Start runs the reconciliation every night at config.ReconcileHourUTC.
+func Start() {
+	go func() {
+		for {
+			time.Sleep(untilNextRun(time.Now().UTC()))
+
+			// Every process schedules the run, only the one taking the lock does it
+			runDate := time.Now().UTC().Format("2006-01-02")
+			var report *model.ReconciliationReport
+			ran, err := database.TryAdvisoryLock(database.LockReconciliation, func() error {
+				// A process waking up late must not redo tonight's run
+				var runs int64
+				err := database.Pool.Model(&model.ReconciliationReport{}).Where("run_date = ?", runDate).Count(&runs).Error
+				if err != nil || runs > 0 {
+					return err
+				}
+
+				report, err = Run(runDate)
+				return err
+			})
+			if err != nil {
+				log.Println("[Reconcile] Run:", err)
+				continue
+			}
+			if !ran || report == nil {
+				log.Println("[Reconcile] Skipped, another process is running it")
+				continue
+			}
+
+			log.Printf("[Reconcile] Checked %d receipt(s): %d corrected, %d pending, %d failed, charged %s, refunded %s",
+				report.Checked, report.Corrected, report.Pending, report.Failed, report.Charged, report.Refunded)
+		}
+	}()
+}
+
+func untilNextRun(now time.Time) time.Duration {
+	next := time.Date(now.Year(), now.Month(), now.Day(), config.ReconcileHourUTC, 0, 0, 0, time.UTC)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+
+	return next.Sub(now)
+}
+
+// Run re-fetches the generation stats of every recent chat receipt whose
+// usage was not final when it was charged, posts the difference to the ledger
+// and records it in a new report. Receipts still without usage are retried on
+// the next run until they are older than config.ReconcileMaxAge. The report
+// is the marker of the run of runDate, so a date is never run twice.
+func Run(runDate string) (*model.ReconciliationReport, error) {
+	report := &model.ReconciliationReport{RunDate: runDate, StartedAt: time.Now()}
+	if err := database.Pool.Create(report).Error; err != nil {
+		return nil, err
+	}
+
+	var receipts []pendingReceipt
+	err := database.Pool.Table("receipts AS r").
+		Select("r.id AS receipt_id, l.user_id, r.model_type, l.amount AS charged").
+		Joins("JOIN ledger_entries AS l ON l.source_id = r.id AND l.source_type = ? AND l.entry_type = ?", ledger.SourceGeneration, ledger.EntryChat).
+		Where("r.finalized = ? AND r.deleted_at IS NULL", false).
+		Where("l.created_at BETWEEN ? AND ?", time.Now().Add(-config.ReconcileMaxAge), time.Now().Add(-config.ReconcileMinAge)).
+		Scan(&receipts).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, receipt := range receipts {
+		report.Checked++
+
+		discrepancy, entry, err := reconcileReceipt(report.ID, receipt)
+		if errors.Is(err, errUsagePending) {
+			report.Pending++
+			continue
+		}
+		if err != nil {
+			log.Printf("[Reconcile] Receipt %s: %v", receipt.ReceiptID, err)
+			report.Failed++
+			continue
+		}
+
+		if discrepancy == nil {
+			continue
+		}
+
+		report.Corrected++
+		if discrepancy.Difference > 0 {
+			report.Charged += discrepancy.Difference
+			notify.BalanceChanged(receipt.UserID, entry.BalanceAfter)
+		} else {
+			report.Refunded -= discrepancy.Difference
+		}
+	}
+
+	report.FinishedAt = time.Now()
+	err = database.Pool.Model(report).Select("finished_at", "checked", "corrected", "pending", "failed", "charged", "refunded").Updates(report).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+var errUsagePending = errors.New("generation usage not final yet")
+
+// reconcileReceipt finalizes one receipt and returns the discrepancy and its
+// corrective ledger entry, or nils when the original charge was already right.
+func reconcileReceipt(reportID uint, receipt pendingReceipt) (*model.ReconciliationDiscrepancy, *model.LedgerEntry, error) {
+	responseBody, err := config.FetchGeneration(receipt.ReceiptID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	generation := model.ReceiptResponse{}
+	err = sonic.Unmarshal(responseBody, &generation)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stats := generation.Data
+	if stats.Usage <= 0 {
+		return nil, nil, errUsagePending
+	}
+
+	modelType := stats.ModelType
+	if modelType == "" {
+		modelType = receipt.ModelType
+	}
+
+	price := config.GetModelPrice(modelType)
+	actual := model.NewCredits(price.Charge(stats.Usage.Float64(), stats.TokensPrompt, stats.TokensCompletion))
+	difference := actual - receipt.Charged
+
+	var discrepancy *model.ReconciliationDiscrepancy
+	var entry *model.LedgerEntry
+	err = database.Pool.Transaction(func(tx *gorm.DB) error {
+		if difference != 0 {
+			// A debit for undercharges, a credit back for overcharges. The
+			// entry is keyed on the receipt, so a receipt is corrected once
+			// and a correction found already posted only finalizes it
+			var err error
+			entry, err = ledger.PostTx(tx, ledger.Posting{
+				UserID:         receipt.UserID,
+				EntryType:      ledger.EntryChatCorrection,
+				Amount:         -difference,
+				Counterparty:   ledger.AccountRevenue,
+				SourceType:     ledger.SourceGeneration,
+				SourceID:       receipt.ReceiptID,
+				Memo:           modelType,
+				AllowOverdraft: true,
+			})
+			if errors.Is(err, ledger.ErrDuplicateEntry) {
+				entry = nil
+			} else if err != nil {
+				return err
+			}
+		}
+
+		if entry != nil {
+			discrepancy = &model.ReconciliationDiscrepancy{
+				ReportID:      reportID,
+				ReceiptID:     receipt.ReceiptID,
+				UserID:        receipt.UserID,
+				ModelType:     modelType,
+				Charged:       receipt.Charged,
+				Actual:        actual,
+				Difference:    difference,
+				LedgerEntryID: entry.ID,
+			}
+			if err := tx.Create(discrepancy).Error; err != nil {
+				return err
+			}
+
+			err = tx.Model(&model.CreditUsageHistory{}).
+				Where("generation_id = ? AND request_type = ?", receipt.ReceiptID, "chat").
+				Update("amount", actual).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Model(&model.Receipt{}).Where("id = ?", receipt.ReceiptID).Updates(map[string]interface{}{
+			"tokens_prompt":     stats.TokensPrompt,
+			"tokens_completion": stats.TokensCompletion,
+			"generation_time":   stats.GenerationTime,
+			"usage":             actual,
+			"finalized":         true,
+		}).Error
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return discrepancy, entry, nil
+}
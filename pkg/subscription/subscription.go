@@ -0,0 +1,220 @@
+// Package subscription derives a user's subscription state from RevenueCat
+// events. It does no I/O so every event type can be tested from a payload.
+package subscription
+
+import (
+	"github.com/vndee/lensquery-backend/pkg/config"
+	"github.com/vndee/lensquery-backend/pkg/model"
+)
+
+// Subscription statuses. Stored subscriptions never have StatusNone, it only
+// reports users without one; before their first event they have status "".
+const (
+	StatusNone                   = "none"
+	StatusActive                 = "active"
+	StatusInGrace                = "in_grace"
+	StatusPaused                 = "paused"
+	StatusCancelledPendingExpiry = "cancelled_pending_expiry"
+	StatusExpired                = "expired"
+	StatusRefunded               = "refunded"
+)
+
+// CancelReasonRefund is the cancel_reason RevenueCat reports for refunds.
+const CancelReasonRefund = "CUSTOMER_SUPPORT"
+
+// transitions lists the statuses each status may move to. Staying in the same
+// status is always allowed, so events can update the other fields. Any status
+// is reachable from "" because tracking may start mid-subscription.
+var transitions = map[string][]string{
+	StatusActive:                 {StatusInGrace, StatusPaused, StatusCancelledPendingExpiry, StatusExpired, StatusRefunded},
+	StatusInGrace:                {StatusActive, StatusCancelledPendingExpiry, StatusExpired, StatusRefunded},
+	StatusPaused:                 {StatusActive, StatusCancelledPendingExpiry, StatusExpired, StatusRefunded},
+	StatusCancelledPendingExpiry: {StatusActive, StatusInGrace, StatusExpired, StatusRefunded},
+	StatusExpired:                {StatusActive, StatusRefunded},
+	StatusRefunded:               {StatusActive},
+}
+
+// CanTransition reports whether a subscription may move from one status to
+// another.
+func CanTransition(from string, to string) bool {
+	if from == "" || from == to {
+		return true
+	}
+
+	for _, allowed := range transitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PlanLookup resolves a store product to its plan.
+type PlanLookup func(store string, productID string) (config.Plan, bool)
+
+// Apply returns the subscription after event and whether the event changed
+// it. Events older than the last applied one are ignored, since RevenueCat
+// does not guarantee delivery order, and so are events that would make an
+// invalid transition.
+func Apply(current model.Subscription, event *model.Event, plans PlanLookup) (model.Subscription, bool) {
+	if event.EventTimestampMs < current.LastEventAtMs {
+		return current, false
+	}
+
+	sub := current
+
+	switch event.Type {
+	case "INITIAL_PURCHASE", "RENEWAL":
+		sub.Store = event.Store
+		sub.ProductID = event.ProductID
+		sub.PendingProductID = ""
+		sub.Status = StatusActive
+		sub.OriginalTransactionID = event.OriginalTransactionID
+		sub.TransactionID = event.TransactionID
+		sub.PurchasedAtMs = event.PurchasedAtMs
+		sub.ExpirationAtMs = event.ExpirationAtMs
+		sub.GracePeriodExpiresAtMs = 0
+		sub.AutoResumeAtMs = 0
+
+	case "CANCELLATION":
+		sub.Status = StatusCancelledPendingExpiry
+		if event.CancelReason == CancelReasonRefund {
+			sub.Status = StatusRefunded
+		}
+		sub.ExpirationAtMs = event.ExpirationAtMs
+
+	case "UNCANCELLATION":
+		if sub.Status != StatusCancelledPendingExpiry {
+			return current, false
+		}
+		sub.Status = StatusActive
+
+	case "SUBSCRIPTION_PAUSED":
+		// The pause takes effect once the current period ends
+		sub.Status = StatusPaused
+		sub.AutoResumeAtMs = event.AutoResumeAtMs
+
+	case "BILLING_ISSUE":
+		sub.Status = StatusInGrace
+		sub.GracePeriodExpiresAtMs = event.GracePeriodExpirationAtMs
+		if sub.GracePeriodExpiresAtMs == 0 {
+			sub.GracePeriodExpiresAtMs = event.EventTimestampMs + config.BillingGracePeriod.Milliseconds()
+		}
+
+	case "PRODUCT_CHANGE":
+		if event.NewProductID == "" || event.NewProductID == sub.ProductID {
+			return current, false
+		}
+
+		// Upgrades apply right away, downgrades at the next renewal
+		if IsUpgrade(event.Store, sub.ProductID, event.NewProductID, plans) {
+			sub.ProductID = event.NewProductID
+			sub.PendingProductID = ""
+		} else {
+			sub.PendingProductID = event.NewProductID
+		}
+
+	case "SUBSCRIPTION_EXTENDED":
+		sub.ExpirationAtMs = event.ExpirationAtMs
+		if sub.Status == StatusExpired || sub.Status == StatusInGrace {
+			sub.Status = StatusActive
+			sub.GracePeriodExpiresAtMs = 0
+		}
+
+	case "EXPIRATION":
+		// A refunded subscription stays refunded when it runs out
+		if sub.Status != StatusRefunded {
+			sub.Status = StatusExpired
+		}
+		sub.ExpirationAtMs = event.ExpirationAtMs
+		sub.GracePeriodExpiresAtMs = 0
+
+	default:
+		return current, false
+	}
+
+	if !CanTransition(current.Status, sub.Status) {
+		return current, false
+	}
+
+	if sub.UserID == "" {
+		sub.UserID = event.AppUserID
+	}
+	if event.Environment != "" {
+		sub.Environment = event.Environment
+	}
+	sub.LastEventID = event.ID
+	sub.LastEventAtMs = event.EventTimestampMs
+
+	return sub, true
+}
+
+// Entitled reports whether the subscription grants its plan at the given
+// time, and until when.
+func Entitled(sub model.Subscription, nowMs int64) (bool, int64) {
+	var until int64
+
+	switch sub.Status {
+	case StatusActive, StatusCancelledPendingExpiry, StatusPaused:
+		// A pause starts once the paid period is over
+		until = sub.ExpirationAtMs
+	case StatusInGrace:
+		until = sub.ExpirationAtMs
+		if sub.GracePeriodExpiresAtMs > until {
+			until = sub.GracePeriodExpiresAtMs
+		}
+	default:
+		return false, 0
+	}
+
+	return nowMs < until, until
+}
+
+// ActivePlan returns the plan the user is entitled to at the given time,
+// falling back to config.FreePlan, and whether it comes from a subscription.
+func ActivePlan(sub model.Subscription, nowMs int64, plans PlanLookup) (config.Plan, bool) {
+	if entitled, _ := Entitled(sub, nowMs); !entitled {
+		return config.FreePlan, false
+	}
+
+	plan, ok := plans(sub.Store, sub.ProductID)
+	if !ok {
+		return config.FreePlan, false
+	}
+
+	return plan, true
+}
+
+// IsUpgrade reports whether moving from one product to another is a move to
+// a higher tier. Moving to an unknown product is never an upgrade.
+func IsUpgrade(store string, fromProductID string, toProductID string, plans PlanLookup) bool {
+	to, ok := plans(store, toProductID)
+	if !ok {
+		return false
+	}
+
+	from, ok := plans(store, fromProductID)
+	if !ok {
+		return true
+	}
+
+	return to.Outranks(from)
+}
+
+// Transfer moves the entitlement of sub to another user. It returns the
+// subscription of the receiving user and what is left for the previous one.
+func Transfer(sub model.Subscription, toUserID string, event *model.Event) (model.Subscription, model.Subscription) {
+	moved := sub
+	moved.Model = nil
+	moved.UserID = toUserID
+	moved.LastEventID = event.ID
+	moved.LastEventAtMs = event.EventTimestampMs
+
+	revoked := sub
+	revoked.Status = StatusExpired
+	revoked.LastEventID = event.ID
+	revoked.LastEventAtMs = event.EventTimestampMs
+
+	return moved, revoked
+}
@@ -0,0 +1,346 @@
+package subscription
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/bytedance/sonic"
+	"github.com/vndee/lensquery-backend/pkg/config"
+	"github.com/vndee/lensquery-backend/pkg/model"
+)
+
+var testPlans = map[string]config.Plan{
+	"lq_starter_plan":  {Name: "Starter Plan", EquationOCRSnap: 50, TextOCRSnap: 300},
+	"lq_standard_plan": {Name: "Standard Plan", EquationOCRSnap: 110, TextOCRSnap: 700},
+	"lq_premium_plan":  {Name: "Premium Plan", EquationOCRSnap: 180, TextOCRSnap: 1500},
+}
+
+func lookupTestPlan(store string, productID string) (config.Plan, bool) {
+	plan, ok := testPlans[productID]
+	return plan, ok
+}
+
+func loadEvent(t *testing.T, name string) *model.Event {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := model.WebhookPayload{}
+	if err := sonic.Unmarshal(data, &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	return &payload.Event
+}
+
+func activeSubscription() model.Subscription {
+	return model.Subscription{
+		UserID:                "user_1",
+		Store:                 "APP_STORE",
+		ProductID:             "lq_standard_plan",
+		Status:                StatusActive,
+		Environment:           "PRODUCTION",
+		OriginalTransactionID: "1000000900000001",
+		TransactionID:         "1000000900000002",
+		PurchasedAtMs:         1700000000000,
+		ExpirationAtMs:        1702592000000,
+		LastEventAtMs:         1700000000000,
+	}
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		before  func(*model.Subscription)
+		changed bool
+		want    func(*model.Subscription)
+	}{
+		{
+			name:    "uncancellation reactivates a cancelled subscription",
+			payload: "uncancellation",
+			before:  func(s *model.Subscription) { s.Status = StatusCancelledPendingExpiry },
+			changed: true,
+			want:    func(s *model.Subscription) { s.Status = StatusActive },
+		},
+		{
+			name:    "uncancellation of an active subscription is a no-op",
+			payload: "uncancellation",
+			changed: false,
+		},
+		{
+			name:    "pause records when the subscription resumes",
+			payload: "subscription_paused",
+			changed: true,
+			want: func(s *model.Subscription) {
+				s.Status = StatusPaused
+				s.AutoResumeAtMs = 1705000000000
+			},
+		},
+		{
+			name:    "billing issue starts the store grace period",
+			payload: "billing_issue",
+			changed: true,
+			want: func(s *model.Subscription) {
+				s.Status = StatusInGrace
+				s.GracePeriodExpiresAtMs = 1703974400000
+			},
+		},
+		{
+			name:    "billing issue without store grace period uses the default",
+			payload: "billing_issue_no_grace",
+			changed: true,
+			want: func(s *model.Subscription) {
+				s.Status = StatusInGrace
+				s.GracePeriodExpiresAtMs = 1702592000000 + config.BillingGracePeriod.Milliseconds()
+			},
+		},
+		{
+			name:    "upgrade applies immediately",
+			payload: "product_change_upgrade",
+			changed: true,
+			want:    func(s *model.Subscription) { s.ProductID = "lq_premium_plan" },
+		},
+		{
+			name:    "downgrade waits for the next renewal",
+			payload: "product_change_downgrade",
+			changed: true,
+			want:    func(s *model.Subscription) { s.PendingProductID = "lq_starter_plan" },
+		},
+		{
+			name:    "extension moves the expiration",
+			payload: "subscription_extended",
+			changed: true,
+			want:    func(s *model.Subscription) { s.ExpirationAtMs = 1703200000000 },
+		},
+		{
+			name:    "extension ends the grace period",
+			payload: "subscription_extended",
+			before: func(s *model.Subscription) {
+				s.Status = StatusInGrace
+				s.GracePeriodExpiresAtMs = 1703974400000
+			},
+			changed: true,
+			want: func(s *model.Subscription) {
+				s.Status = StatusActive
+				s.GracePeriodExpiresAtMs = 0
+				s.ExpirationAtMs = 1703200000000
+			},
+		},
+		{
+			name:    "expiration ends the subscription",
+			payload: "expiration",
+			changed: true,
+			want:    func(s *model.Subscription) { s.Status = StatusExpired },
+		},
+		{
+			name:    "cancellation keeps access until expiration",
+			payload: "cancellation",
+			changed: true,
+			want:    func(s *model.Subscription) { s.Status = StatusCancelledPendingExpiry },
+		},
+		{
+			name:    "refund cancellation ends the subscription",
+			payload: "cancellation_refund",
+			changed: true,
+			want:    func(s *model.Subscription) { s.Status = StatusRefunded },
+		},
+		{
+			name:    "expiration keeps a refunded subscription refunded",
+			payload: "expiration",
+			before:  func(s *model.Subscription) { s.Status = StatusRefunded },
+			changed: true,
+		},
+		{
+			name:    "pause of a refunded subscription is rejected",
+			payload: "subscription_paused",
+			before:  func(s *model.Subscription) { s.Status = StatusRefunded },
+			changed: false,
+		},
+		{
+			name:    "stale events are ignored",
+			payload: "subscription_paused",
+			before:  func(s *model.Subscription) { s.LastEventAtMs = 1700200000000 },
+			changed: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := loadEvent(t, tt.payload)
+
+			before := activeSubscription()
+			if tt.before != nil {
+				tt.before(&before)
+			}
+
+			got, changed := Apply(before, event, lookupTestPlan)
+			if changed != tt.changed {
+				t.Fatalf("changed = %v, want %v", changed, tt.changed)
+			}
+
+			want := before
+			if tt.changed {
+				if tt.want != nil {
+					tt.want(&want)
+				}
+				want.LastEventID = event.ID
+				want.LastEventAtMs = event.EventTimestampMs
+			}
+
+			if got != want {
+				t.Errorf("got  %+v\nwant %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	tests := []struct {
+		name        string
+		payload     string
+		before      func(*model.Subscription)
+		wantMoved   func(*model.Subscription)
+		wantRevoked func(*model.Subscription)
+	}{
+		{
+			name:        "active subscription moves to the new user",
+			payload:     "transfer",
+			wantMoved:   func(s *model.Subscription) { s.UserID = "user_2" },
+			wantRevoked: func(s *model.Subscription) { s.Status = StatusExpired },
+		},
+		{
+			name:    "grace period moves with the subscription",
+			payload: "transfer",
+			before: func(s *model.Subscription) {
+				s.Status = StatusInGrace
+				s.GracePeriodExpiresAtMs = 1703974400000
+			},
+			wantMoved:   func(s *model.Subscription) { s.UserID = "user_2" },
+			wantRevoked: func(s *model.Subscription) { s.Status = StatusExpired },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := loadEvent(t, tt.payload)
+
+			before := activeSubscription()
+			if tt.before != nil {
+				tt.before(&before)
+			}
+
+			moved, revoked := Transfer(before, event.TransferredTo[0], event)
+
+			wantMoved, wantRevoked := before, before
+			tt.wantMoved(&wantMoved)
+			tt.wantRevoked(&wantRevoked)
+			for _, want := range []*model.Subscription{&wantMoved, &wantRevoked} {
+				want.LastEventID = event.ID
+				want.LastEventAtMs = event.EventTimestampMs
+			}
+
+			if moved != wantMoved {
+				t.Errorf("moved   %+v\nwant    %+v", moved, wantMoved)
+			}
+			if revoked != wantRevoked {
+				t.Errorf("revoked %+v\nwant    %+v", revoked, wantRevoked)
+			}
+		})
+	}
+}
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from string
+		to   string
+		want bool
+	}{
+		{"", StatusActive, true},
+		{"", StatusExpired, true},
+		{StatusActive, StatusActive, true},
+		{StatusActive, StatusInGrace, true},
+		{StatusActive, StatusPaused, true},
+		{StatusActive, StatusCancelledPendingExpiry, true},
+		{StatusActive, StatusExpired, true},
+		{StatusActive, StatusRefunded, true},
+		{StatusInGrace, StatusActive, true},
+		{StatusInGrace, StatusPaused, false},
+		{StatusPaused, StatusActive, true},
+		{StatusPaused, StatusInGrace, false},
+		{StatusCancelledPendingExpiry, StatusActive, true},
+		{StatusCancelledPendingExpiry, StatusPaused, false},
+		{StatusExpired, StatusActive, true},
+		{StatusExpired, StatusInGrace, false},
+		{StatusExpired, StatusCancelledPendingExpiry, false},
+		{StatusRefunded, StatusActive, true},
+		{StatusRefunded, StatusExpired, false},
+		{StatusRefunded, StatusPaused, false},
+	}
+
+	for _, tt := range tests {
+		if got := CanTransition(tt.from, tt.to); got != tt.want {
+			t.Errorf("CanTransition(%q, %q) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestEntitled(t *testing.T) {
+	const expiration = 1702592000000
+
+	tests := []struct {
+		name      string
+		status    string
+		grace     int64
+		now       int64
+		want      bool
+		wantUntil int64
+	}{
+		{"active", StatusActive, 0, expiration - 1, true, expiration},
+		{"active past expiration", StatusActive, 0, expiration, false, expiration},
+		{"cancelled before expiration", StatusCancelledPendingExpiry, 0, expiration - 1, true, expiration},
+		{"paused before period end", StatusPaused, 0, expiration - 1, true, expiration},
+		{"in grace", StatusInGrace, expiration + 1000, expiration + 1, true, expiration + 1000},
+		{"grace over", StatusInGrace, expiration + 1000, expiration + 1000, false, expiration + 1000},
+		{"expired", StatusExpired, 0, expiration - 1, false, 0},
+		{"refunded", StatusRefunded, 0, expiration - 1, false, 0},
+		{"unknown", "", 0, expiration - 1, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub := activeSubscription()
+			sub.Status = tt.status
+			sub.GracePeriodExpiresAtMs = tt.grace
+
+			got, until := Entitled(sub, tt.now)
+			if got != tt.want || until != tt.wantUntil {
+				t.Errorf("Entitled() = %v, %d, want %v, %d", got, until, tt.want, tt.wantUntil)
+			}
+		})
+	}
+}
+
+func TestActivePlan(t *testing.T) {
+	sub := activeSubscription()
+
+	plan, subscribed := ActivePlan(sub, sub.ExpirationAtMs-1, lookupTestPlan)
+	if !subscribed || plan.Name != "Standard Plan" {
+		t.Errorf("ActivePlan() = %v, %v, want Standard Plan", plan.Name, subscribed)
+	}
+
+	plan, subscribed = ActivePlan(sub, sub.ExpirationAtMs, lookupTestPlan)
+	if subscribed || plan.Name != config.FreePlan.Name {
+		t.Errorf("ActivePlan() after expiration = %v, %v, want %v", plan.Name, subscribed, config.FreePlan.Name)
+	}
+
+	sub.ProductID = "lq_unknown_plan"
+	plan, subscribed = ActivePlan(sub, sub.ExpirationAtMs-1, lookupTestPlan)
+	if subscribed || plan.Name != config.FreePlan.Name {
+		t.Errorf("ActivePlan() of unknown product = %v, %v, want %v", plan.Name, subscribed, config.FreePlan.Name)
+	}
+}
@@ -9,6 +9,13 @@ type HTMLTemplates struct {
 	Expiration      *template.Template
 	ResetPassword   *template.Template
 	VerifyEmail     *template.Template
+	LowBalance      *template.Template
+	Uncancellation  *template.Template
+	Paused          *template.Template
+	BillingIssue    *template.Template
+	ProductChange   *template.Template
+	Extension       *template.Template
+	Transfer        *template.Template
 }
 
 const (
@@ -18,6 +25,13 @@ const (
 	EXPIRATION     = "./pkg/templates/expire.html"
 	RESET_PASSWORD = "./pkg/templates/reset_password.html"
 	VERIFY_EMAIL   = "./pkg/templates/verify_email.html"
+	LOW_BALANCE    = "./pkg/templates/low_balance.html"
+	UNCANCELLATION = "./pkg/templates/uncancel.html"
+	PAUSED         = "./pkg/templates/pause.html"
+	BILLING_ISSUE  = "./pkg/templates/billing_issue.html"
+	PRODUCT_CHANGE = "./pkg/templates/product_change.html"
+	EXTENSION      = "./pkg/templates/extend.html"
+	TRANSFER       = "./pkg/templates/transfer.html"
 )
 
 var EmailTemplates *HTMLTemplates
@@ -49,5 +63,33 @@ func Load() error {
 	if err != nil {
 		return err
 	}
+	EmailTemplates.LowBalance, err = template.ParseFiles(LOW_BALANCE)
+	if err != nil {
+		return err
+	}
+	EmailTemplates.Uncancellation, err = template.ParseFiles(UNCANCELLATION)
+	if err != nil {
+		return err
+	}
+	EmailTemplates.Paused, err = template.ParseFiles(PAUSED)
+	if err != nil {
+		return err
+	}
+	EmailTemplates.BillingIssue, err = template.ParseFiles(BILLING_ISSUE)
+	if err != nil {
+		return err
+	}
+	EmailTemplates.ProductChange, err = template.ParseFiles(PRODUCT_CHANGE)
+	if err != nil {
+		return err
+	}
+	EmailTemplates.Extension, err = template.ParseFiles(EXTENSION)
+	if err != nil {
+		return err
+	}
+	EmailTemplates.Transfer, err = template.ParseFiles(TRANSFER)
+	if err != nil {
+		return err
+	}
 	return nil
 }